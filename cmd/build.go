@@ -23,9 +23,21 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
-	"path"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/iisteev/mypkg/pkg/mpkg"
 
@@ -34,29 +46,55 @@ import (
 	"github.com/spf13/viper"
 )
 
-var packageDesc *mpkg.PackageDesc
-
-// readFileDefinition reads in config file and ENV variables if set.
-func readFileDefinition(fileDefinition *string) {
-	if fileDefinition == nil {
-		log.Fatal("No file provided description provided")
-	}
-
-	vsd = viper.New()
+// readFileDefinition reads the package description file and ENV variables if set.
+func readFileDefinition(fileDefinition string) (*mpkg.PackageDesc, error) {
+	vsd := viper.New()
 
 	// Use config file from the flag.
-	vsd.SetConfigFile(*fileDefinition)
+	vsd.SetConfigFile(fileDefinition)
 	vsd.AutomaticEnv() // read in environment variables that match
+	vsd.SetEnvKeyReplacer(envKeyReplacer)
 
 	// If a config file is found, read it in.
 	if err := vsd.ReadInConfig(); err != nil {
-		log.Fatalf("Could not read file %v, %v\n", fileDefinition, err)
+		return nil, fmt.Errorf("could not read file %v, %w", fileDefinition, err)
 	}
 	log.Infof("Using package description file: %v\n", vsd.ConfigFileUsed())
-	// Use config file from the flag.
-	if err := vsd.Unmarshal(&packageDesc); err != nil {
-		log.Fatalf("unable to decode into struct, %v\n", err)
+	var desc *mpkg.PackageDesc
+	if err := vsd.Unmarshal(&desc); err != nil {
+		return nil, fmt.Errorf("unable to decode %v into struct, %w", fileDefinition, err)
+	}
+	// The name, version and release must be parsed back from the package file name
+	if err := desc.ID().Validate(); err != nil {
+		return nil, fmt.Errorf("invalid package description %v: %w", fileDefinition, err)
+	}
+	for step := range desc.Timeout {
+		if !slices.Contains(mpkg.Steps, step) {
+			return nil, fmt.Errorf("invalid timeout in %v: unknown step %v, steps are %v", fileDefinition, step, strings.Join(mpkg.Steps, ", "))
+		}
+	}
+	return desc, nil
+}
+
+// findRecipes returns the recipe files of args, the yaml files of the directories
+// are listed. multi is set when there are several recipes or a directory.
+func findRecipes(args []string) (recipes []string, multi bool, err error) {
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil || !info.IsDir() {
+			recipes = append(recipes, arg)
+			continue
+		}
+		multi = true
+		for _, pattern := range []string{"*.yaml", "*.yml"} {
+			matches, err := filepath.Glob(filepath.Join(arg, pattern))
+			if err != nil {
+				return nil, false, err
+			}
+			recipes = append(recipes, matches...)
+		}
 	}
+	return recipes, multi || len(recipes) > 1, nil
 }
 
 // buildCmd represents the build command
@@ -82,121 +120,692 @@ build    :
   - $make
 install  :
   - $make_install
+depends  :
+  - autoconf
+  - automake
 ---
+The source can list other places of the tarball in uris, tried in order when
+uri fails or does not match the sha256. mirror://NAME/PATH is PATH on each
+mirror NAME of the mirrors in config, gnu and sourceforge are known, e.g.:
+mirrors:
+  gnu:
+    - https://mirrors.kernel.org/gnu
+
 A macro starts with $, defined macros are:
 $configure     : ./configure ${CONF_OPTS}
 $make          : make -j${NBJOBS-1} ${MAKE_OPTS}
 $make_install  : make install DESTDIR=${INSTALL_DIR-${prefix}} ${MAKE_INSTALL_OPTS}
+
+A step taking longer than its timeout is stopped, for example:
+timeout  :
+  build: 2h
+
+Each command of a step runs in its own /bin/sh, in order, and the step stops at
+the first one that fails. The variables a command sets and its working
+directory carry over to the next commands of the step.
+
+The commands run with /bin/sh, or the shell of config, or the shell of the
+recipe, options included, for example:
+shell    : bash -o pipefail
+A command starting with #! is a script, run with the interpreter it names, the
+variables are exported to it:
+build    :
+  - |
+    #!/usr/bin/env python3
+    import os
+    print(os.environ["PREFIX"])
+
+With --clean-env, or cleanEnv: true in config, the steps do not inherit the
+environment of mypkg: they start with the variables of envAllowlist in config
+(PATH, HOME, TERM by default), and the variables of mypkg exported, then the
+environment of config applies. The environment is recorded in the package.
+
+On interrupt, the commands running and their children are killed, and the work
+directories are removed unless they are to be kept.
+
+With --sandbox, or sandbox: true in config, the steps run on Linux in user and
+mount namespaces, without network. Only buildDir and installDir are writable,
+the prefix, the system directories and the sandboxReadOnly paths of config are
+read-only, and the rest, $HOME included, is hidden. Writes outside buildDir and
+installDir are discarded and make the build fail with the list of their paths.
+
+With --reproducible, or reproducible: true in config, the archive entries are
+sorted, their mtimes are clamped to SOURCE_DATE_EPOCH (the epoch if not set,
+which is also exported to the steps), their modes are normalized to 0755 or 0644
+and they are owned by root, unless another owner is given. --check-reproducible
+builds twice and reports the files that differ.
+
+Several recipes, or directories of recipes, can be given. They are built in the
+order of their depends, up to --jobs at a time, each in a sub directory of
+buildDir, installDir and installDBDir named after the package. Each package is
+installed once built, before the packages depending on it are built. A failure
+stops the build, unless --keep-going is given, then only the packages depending
+on the failed one are skipped. A summary is shown at the end.
+
+The work directories are removed after a successful build, unless
+--keep-build-dir is given, or keepBuildDir: true in config, and kept after a
+failure. The steps done are recorded there: --resume continues the build from
+the first step that did not complete, --from-step from the given step.
+
+for example:
+    mypkg build htop.yaml
+    mypkg build -j 4 --keep-going examples/
+    mypkg build --from-step install htop.yaml
 `,
+	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) != 1 {
-			log.Fatal("Non or more than one argument provided. Accepting ONLY one argument")
+		recipes, multi, err := findRecipes(args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var descs []*mpkg.PackageDesc
+		for _, recipe := range recipes {
+			// Read application file definition
+			desc, err := readFileDefinition(recipe)
+			if err != nil {
+				log.Fatal(err)
+			}
+			descs = append(descs, desc)
+		}
+		var reproducible *mpkg.Reproducible
+		if buildReproducible || buildCheckReproducible || vcfg.GetBool("reproducible") {
+			if reproducible, err = mpkg.NewReproducible(); err != nil {
+				log.Fatal(err)
+			}
+			log.Infof("Reproducible build, files are dated at most %v\n", time.Unix(reproducible.Epoch, 0).UTC())
+		}
+		if buildFromStep != "" && !slices.Contains(mpkg.Steps, buildFromStep) {
+			log.Fatalf("Unknown step %v, steps are %v\n", buildFromStep, strings.Join(mpkg.Steps, ", "))
+		}
+		outDir := buildOutput
+		if outDir == "" {
+			outDir = getCache().PackagesDir()
+		}
+		// The steps are killed on interrupt, a second one exits right away
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-ctx.Done()
+			stop()
+		}()
+		if multi {
+			buildAll(ctx, descs, outDir, reproducible)
+			return
+		}
+		b := newBuilder(descs[0], getWorkDirs(""), outDir, reproducible)
+		if _, err := b.run(ctx); err != nil {
+			log.Fatal(err)
 		}
+	},
+}
 
-		// Read application file definition
-		readFileDefinition(&args[0])
-		buildDir := getKeyFromConf("buildDir")
-		// Check if dbdir exists, if not, create it
-		if err := mpkg.CreateDirIfNotExist(buildDir); err != nil {
-			log.Fatalln(err)
+// workDirs are the directories a package is built in
+type workDirs struct {
+	build     string
+	install   string
+	installDB string
+}
+
+// getWorkDirs returns buildDir, installDir and installDBDir of config,
+// or their sub directory sub if not empty
+func getWorkDirs(sub string) workDirs {
+	return workDirs{
+		build:     filepath.Join(getKeyFromConf("buildDir"), sub),
+		install:   filepath.Join(getKeyFromConf("installDir"), sub),
+		installDB: filepath.Join(getKeyFromConf("installDBDir"), sub),
+	}
+}
+
+// builder builds the package of a recipe
+type builder struct {
+	desc   *mpkg.PackageDesc
+	dirs   workDirs
+	outDir string
+	// reproducible normalizes the archives if not nil
+	reproducible *mpkg.Reproducible
+	// output receives the output of the steps, stdout and stderr if nil
+	output io.Writer
+	// resume continues a previous build, from fromStep if not empty
+	resume   bool
+	fromStep string
+	// keep keeps the work directories after a successful build
+	keep bool
+}
+
+// newBuilder returns the builder of desc in dirs, set up with the flags
+func newBuilder(desc *mpkg.PackageDesc, dirs workDirs, outDir string, reproducible *mpkg.Reproducible) *builder {
+	return &builder{
+		desc:         desc,
+		dirs:         dirs,
+		outDir:       outDir,
+		reproducible: reproducible,
+		resume:       buildResume || buildFromStep != "",
+		fromStep:     buildFromStep,
+		keep:         buildKeepBuildDir || vcfg.GetBool("keepBuildDir"),
+	}
+}
+
+// run fetches the source, builds the package, checks it is reproducible if
+// requested and returns the paths of its archives
+func (b *builder) run(ctx context.Context) ([]string, error) {
+	source, err := fetchSource(ctx, b.desc)
+	if err != nil {
+		return nil, err
+	}
+	archives, err := b.build(ctx, source, b.outDir, b.resume)
+	if err != nil {
+		return nil, err
+	}
+	for _, archive := range archives {
+		log.Infof("Package written in %v\n", archive)
+	}
+	if buildCheckReproducible {
+		if err := b.checkReproducible(ctx, source, archives); err != nil {
+			return nil, err
 		}
-		installDBDir := getKeyFromConf("installDBDir")
-		// Check if installDBDir exists, if not, create it
-		if err := mpkg.CreateDirIfNotExist(installDBDir); err != nil {
-			log.Fatalln(err)
+	}
+	return archives, nil
+}
+
+// fetchSource downloads the source of desc in the cache if needed, verifies it
+// and returns its path
+func fetchSource(ctx context.Context, desc *mpkg.PackageDesc) (string, error) {
+	// The sources are kept in the cache
+	uris := desc.Source.AllURIs()
+	if len(uris) == 0 {
+		return "", fmt.Errorf("no uri for the source of %v", desc.Name)
+	}
+	destinationFileName := getCache().SourcePath(desc.Name, uris[0])
+	if err := mpkg.CreateDirIfNotExist(filepath.Dir(destinationFileName)); err != nil {
+		return "", err
+	}
+	// Download the tarball
+	if err := desc.Source.DownloadIfNoCache(ctx, destinationFileName, getMirrors()); err != nil {
+		return "", fmt.Errorf("could not download file; %w", err)
+	}
+	log.Infof("File downloaded in %s\n", destinationFileName)
+	// Verify the tarball
+	if err := desc.Source.Verify(destinationFileName); err != nil {
+		return "", fmt.Errorf("could not verify file; %w", err)
+	}
+	log.Info("Integrity OK")
+	return destinationFileName, nil
+}
+
+// build builds the package from its source, writes its archives in outDir
+// and returns their paths. With resume, the build continues in the work
+// directories of a previous one, from --from-step or the first step that did
+// not complete.
+func (b *builder) build(ctx context.Context, source, outDir string, resume bool) (archives []string, err error) {
+	desc := b.desc
+	buildDir := b.dirs.build
+	installDBDir := b.dirs.installDB
+	// get prefix and installation directory
+	prefixDir := getKeyFromConf("prefix")
+	installDir := b.dirs.install
+	// The recipe may need another shell than the one of config
+	shell := desc.Shell
+	if shell == "" {
+		shell = vcfg.GetString("shell")
+	}
+	interpreter := strings.Fields(shell)
+	if err := mpkg.CheckInterpreter(interpreter); err != nil {
+		return nil, err
+	}
+	var state *mpkg.BuildState
+	if resume {
+		if state, err = b.resumeState(); err != nil {
+			return nil, err
 		}
-		baseFileName := path.Base(packageDesc.Source.URI)
+	}
+	// resumed is set if the work directories of a previous build are reused
+	resumed := state != nil
+	// From now on the work directories of a failed build are kept or removed by failed
+	defer func() {
+		if err != nil {
+			b.failed(ctx)
+		}
+	}()
+	fromStep := mpkg.Steps[0]
+	if resumed {
+		fromStep = state.NextStep()
+		if b.fromStep != "" {
+			fromStep = b.fromStep
+		}
+	} else {
+		// Start from clean work directories
+		for _, dir := range []string{buildDir, installDir, installDBDir} {
+			if err := os.RemoveAll(dir); err != nil {
+				return nil, err
+			}
+			if err := mpkg.CreateDirIfNotExist(dir); err != nil {
+				return nil, err
+			}
+		}
+		packageBuildDir, err := b.unpack(source)
+		if err != nil {
+			return nil, err
+		}
+		state = &mpkg.BuildState{Package: desc.GetFullName(), SourceDir: packageBuildDir}
+		if err := state.Save(installDBDir); err != nil {
+			return nil, err
+		}
+	}
+	packageBuildDir := state.SourceDir
 
-		var destinationFileName string
-		// Prepare tarball
-		if packageDesc.Source.Decompressed {
-			destinationFileName = filepath.Join(buildDir, baseFileName)
-		} else {
-			destinationFileName = filepath.Join("/tmp", baseFileName)
-		}
-		// Download the tarball
-		if err := packageDesc.Source.DownloadIfNoCache(destinationFileName); err != nil {
-			log.Fatalf("Could not download file; %v\n", err)
-		}
-		log.Infof("File downloaded in %s\n", destinationFileName)
-		// Verify the tarball
-		if err := packageDesc.Source.Verify(destinationFileName); err != nil {
-			log.Fatalf("Could not verify file; %v\n", err)
-		}
-		log.Info("Integrity OK")
-		packageBuildDir := buildDir
-		if !packageDesc.Source.Decompressed {
-			// unpack the tarball
-			if err := packageDesc.Source.Unpack(destinationFileName, buildDir); err != nil {
-				log.Fatalf("Could not unpack tarball; %v\n", err)
+	fullInstallDir := filepath.Join(installDir, prefixDir)
+	command := mpkg.NewShell()
+	command.Interpreter = interpreter
+	vars := []string{
+		"PREFIX=" + prefixDir,
+		"BUILD_DIR=" + buildDir,
+		"INSTALL_DIR=" + installDir,
+		"FULL_INSTALL_DIR=" + fullInstallDir,
+		"PKG_NAME=" + desc.GetFullName(),
+		"PKG_BUILD_DIR=" + packageBuildDir,
+	}
+	for _, value := range vars {
+		command.AddArgs(value)
+	}
+	// A clean environment only has the allowed variables of mypkg and its variables
+	cleanEnv := buildCleanEnv || vcfg.GetBool("cleanEnv")
+	if cleanEnv {
+		allowlist := mpkg.DefaultEnvAllowlist
+		if vcfg.IsSet("envAllowlist") {
+			allowlist = vcfg.GetStringSlice("envAllowlist")
+		}
+		command.Env = mpkg.CleanEnv(allowlist, vars...)
+	}
+	if b.reproducible != nil {
+		command.AddArgs("export " + mpkg.SourceDateEpochEnv + "=" + strconv.FormatInt(b.reproducible.Epoch, 10))
+	}
+	environment := vcfg.GetStringSlice("environment")
+	for _, value := range environment {
+		command.AddArgs(value)
+	}
+	// The sources are fetched, the steps run without network
+	if buildSandbox || vcfg.GetBool("sandbox") {
+		readOnly := append([]string{prefixDir}, vcfg.GetStringSlice("sandboxReadOnly")...)
+		command.Sandbox = mpkg.NewSandbox([]string{buildDir, installDir}, readOnly...)
+		log.Info("Running the steps in a sandbox")
+	}
+	if cleanEnv {
+		env, err := command.Environ(ctx, packageBuildDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not get the build environment: %w", err)
+		}
+		// The environment is recorded in the package
+		desc.Environment = env
+		log.Infof("Running the steps in a clean environment: %v\n", strings.Join(env, " "))
+	}
+
+	// The output of each step is logged in logDir, the logs of the steps
+	// done by a previous build are kept
+	logs := mpkg.NewBuildLogs(getLogDir(), desc.Name)
+	if fromStep == mpkg.Steps[0] {
+		if err := logs.Reset(); err != nil {
+			return nil, err
+		}
+	}
+	steps := map[string]stepFunc{
+		mpkg.StepSetup:   desc.SetupStep,
+		mpkg.StepBuild:   desc.BuildStep,
+		mpkg.StepInstall: desc.InstallStep,
+	}
+	// fromStep is empty when the steps of a previous build all completed
+	if fromStep == "" {
+		log.Infof("All the steps were done by a previous build, packaging %v\n", desc.Name)
+	}
+	started := false
+	for _, step := range mpkg.Steps {
+		if step == fromStep {
+			started = true
+		}
+		if !started {
+			log.Infof("Skipping the %v step, done by a previous build\n", step)
+			continue
+		}
+		// A previous install may have left files
+		if step == mpkg.StepInstall && resumed {
+			if err := os.RemoveAll(installDir); err != nil {
+				return nil, err
 			}
-			log.Infof("Tarball unpacked in %v\n", buildDir)
-			// look for the unpacked tarball folder in destination directory
-			folders, err := os.ReadDir(buildDir)
-			if err != nil {
-				log.Fatal(err)
+			if err := mpkg.CreateDirIfNotExist(installDir); err != nil {
+				return nil, err
 			}
-			if len(folders) != 1 {
-				log.Warnf("We should find only one directory in %v! Anyway using it as a package source\n", buildDir)
-			} else {
-				candidateDir := folders[0]
-				if !candidateDir.IsDir() {
-					log.Fatalf("%v is not a directory\n", candidateDir.Name())
-				}
-				packageBuildDir = filepath.Join(buildDir, candidateDir.Name())
+		}
+		if err := b.runStep(ctx, logs, step, steps[step], command, packageBuildDir); err != nil {
+			return nil, err
+		}
+		state.Complete(step)
+		if err := state.Save(installDBDir); err != nil {
+			return nil, err
+		}
+	}
+	// Prepare package file
+	pkgPath := filepath.Join(installDBDir, desc.GetFullName())
+	// Create the xml files metadata
+	if err := mpkg.CreateDirIfNotExist(pkgPath); err != nil {
+		return nil, err
+	}
+	// write files.xml
+	owner, err := getBuildOwner(b.reproducible != nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid owner: %w", err)
+	}
+	// files.xml may have been written by a previous build
+	if err := os.Remove(filepath.Join(installDir, prefixDir, mpkg.FilesXMLName)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := mpkg.WritePackageXMLFile(installDir, prefixDir, owner, desc.FileTypes); err != nil {
+		return nil, err
+	}
+	// Archive it
+	log.Println("Packaging...")
+	signingKey := getSigningKey()
+	if signingKey == nil {
+		log.Warn("No signingKey in config, the package will not be signed")
+	}
+	archives, err = desc.Archive(installDir, outDir, prefixDir, signingKey, b.reproducible)
+	if err != nil {
+		return nil, err
+	}
+	if b.keep {
+		log.Infof("Work directories kept in %v, %v and %v\n", buildDir, installDir, installDBDir)
+		return archives, nil
+	}
+	log.Println("Cleanup...")
+	os.RemoveAll(installDir)
+	os.RemoveAll(buildDir)
+	os.RemoveAll(installDBDir)
+	return archives, nil
+}
+
+// failed handles the work directories of a build that failed. They are kept
+// to resume the build, unless it was interrupted and they are not to be kept.
+func (b *builder) failed(ctx context.Context) {
+	if ctx.Err() == nil || b.keep {
+		log.Infof("Work directories kept, run 'mypkg build --resume' to continue the build of %v\n", b.desc.Name)
+		return
+	}
+	log.Infof("Build of %v interrupted, removing its work directories\n", b.desc.Name)
+	os.RemoveAll(b.dirs.install)
+	os.RemoveAll(b.dirs.build)
+	os.RemoveAll(b.dirs.installDB)
+}
+
+// resumeState returns the state of the build to resume, or nil if there is none
+// and the build starts from scratch
+func (b *builder) resumeState() (*mpkg.BuildState, error) {
+	state, err := mpkg.LoadBuildState(b.dirs.installDB)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		if b.fromStep != "" {
+			return nil, fmt.Errorf("no build of %v to continue from the %v step in %v", b.desc.Name, b.fromStep, b.dirs.build)
+		}
+		log.Infof("No build of %v to resume, starting from scratch\n", b.desc.Name)
+		return nil, nil
+	}
+	if state.Package != b.desc.GetFullName() {
+		return nil, fmt.Errorf("the work directories hold a build of %v, not %v", state.Package, b.desc.GetFullName())
+	}
+	if b.fromStep != "" {
+		for _, step := range mpkg.Steps {
+			if step == b.fromStep {
+				break
+			}
+			if !slices.Contains(state.Completed, step) {
+				log.Warnf("The %v step did not complete, continuing from the %v step anyway\n", step, b.fromStep)
 			}
 		}
+	}
+	log.Infof("Resuming the build of %v in %v\n", state.Package, b.dirs.build)
+	return state, nil
+}
+
+// unpack unpacks source in the build directory and returns the directory of the
+// unpacked source
+func (b *builder) unpack(source string) (string, error) {
+	buildDir := b.dirs.build
+	if b.desc.Source.Decompressed {
+		return buildDir, mpkg.CopyFile(source, filepath.Join(buildDir, filepath.Base(source)))
+	}
+	// unpack the tarball
+	if err := b.desc.Source.Unpack(source, buildDir); err != nil {
+		return "", fmt.Errorf("could not unpack tarball; %w", err)
+	}
+	log.Infof("Tarball unpacked in %v\n", buildDir)
+	// look for the unpacked tarball folder in destination directory
+	folders, err := os.ReadDir(buildDir)
+	if err != nil {
+		return "", err
+	}
+	if len(folders) != 1 {
+		log.Warnf("We should find only one directory in %v! Anyway using it as a package source\n", buildDir)
+		return buildDir, nil
+	}
+	candidateDir := folders[0]
+	if !candidateDir.IsDir() {
+		return "", fmt.Errorf("%v is not a directory", candidateDir.Name())
+	}
+	return filepath.Join(buildDir, candidateDir.Name()), nil
+}
+
+// stepFunc runs the commands of a step with a shell in a directory
+type stepFunc func(ctx context.Context, shell *mpkg.Shell, dir string) ([]mpkg.CommandResult, error)
+
+// runStep runs step with command in dir and logs its output. On failure, the
+// last lines of the log are shown.
+func (b *builder) runStep(ctx context.Context, logs *mpkg.BuildLogs, step string, run stepFunc, command *mpkg.Shell, dir string) error {
+	timeout := b.desc.Timeout[step]
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	stepLog, err := logs.Start(b.desc.ID(), step)
+	if err != nil {
+		return err
+	}
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if b.output != nil {
+		stdout, stderr = b.output, b.output
+	}
+	command.Stdout = io.MultiWriter(stdout, stepLog)
+	command.Stderr = io.MultiWriter(stderr, stepLog)
+	results, err := run(ctx, command, dir)
+	stepLog.Results(results)
+	if closeErr := stepLog.Close(err); closeErr != nil {
+		log.Warnf("Could not write %v: %v\n", stepLog.Path, closeErr)
+	}
+	if err == nil {
+		return nil
+	}
+	if lines, tailErr := mpkg.TailFile(stepLog.Path, logTailLines); tailErr == nil {
+		fmt.Fprintf(os.Stderr, "Last lines of the %s step of %s:\n", step, b.desc.Name)
+		for _, line := range lines {
+			fmt.Fprintln(os.Stderr, "  "+line)
+		}
+	}
+	if timeout > 0 && errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%s step timed out after %v (full log in %s): %w", step, timeout, stepLog.Path, err)
+	}
+	var commandErr *mpkg.CommandError
+	if errors.As(err, &commandErr) {
+		return fmt.Errorf("%w (full log in %s)", err, stepLog.Path)
+	}
+	return fmt.Errorf("%s step failed (full log in %s): %w", step, stepLog.Path, err)
+}
+
+// logTailLines is the number of lines of the log shown when a step fails
+const logTailLines = 20
 
-		// get prefix and installation directory
-		prefixDir := getKeyFromConf("prefix")
-		installDir := getKeyFromConf("installDir")
-		fullInstallDir := filepath.Join(installDir, prefixDir)
-		command := mpkg.NewShell()
-		command.AddArgs("PREFIX=" + prefixDir)
-		command.AddArgs("BUILD_DIR=" + buildDir)
-		command.AddArgs("INSTALL_DIR=" + installDir)
-		command.AddArgs("FULL_INSTALL_DIR=" + fullInstallDir)
-		command.AddArgs("PKG_NAME=" + packageDesc.GetFullName())
-		command.AddArgs("PKG_BUILD_DIR=" + packageBuildDir)
-		environment := vcfg.GetStringSlice("environment")
-		for _, value := range environment {
-			command.AddArgs(value)
+// checkReproducible builds the package a second time and compares its
+// archives with the ones of the first build
+func (b *builder) checkReproducible(ctx context.Context, source string, archives []string) error {
+	log.Infof("Building %v a second time to check that the build is reproducible\n", b.desc.Name)
+	tmpDir, err := os.MkdirTemp("", "mypkg-check-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	if _, err := b.build(ctx, source, tmpDir, false); err != nil {
+		return fmt.Errorf("second build failed: %w", err)
+	}
+	reproduced := true
+	for _, archive := range archives {
+		diffs, err := mpkg.CompareArchives(archive, filepath.Join(tmpDir, filepath.Base(archive)))
+		if err != nil {
+			return err
+		}
+		for _, diff := range diffs {
+			fmt.Printf("%s: %s\n", filepath.Base(archive), diff)
+		}
+		if len(diffs) > 0 {
+			reproduced = false
+		} else {
+			log.Infof("%v is reproducible\n", filepath.Base(archive))
 		}
+	}
+	if !reproduced {
+		return fmt.Errorf("the build of %v is not reproducible", b.desc.Name)
+	}
+	return nil
+}
 
-		if err := packageDesc.SetupStep(command, packageBuildDir); err != nil {
-			log.Fatal(err)
+// buildAll builds descs in the order of their dependencies, up to --jobs at a
+// time, and installs each package before building the ones depending on it
+func buildAll(ctx context.Context, descs []*mpkg.PackageDesc, outDir string, reproducible *mpkg.Reproducible) {
+	// The dependencies that are not built must be installed
+	names := map[string]bool{}
+	for _, desc := range descs {
+		names[desc.Name] = true
+	}
+	db := openDB(true)
+	for _, desc := range descs {
+		for _, dep := range desc.Depends {
+			if !names[dep] && db.Get(dep) == nil {
+				log.Fatalf("%v depends on %v which is neither installed nor built\n", desc.Name, dep)
+			}
 		}
-		// build
-		if err := packageDesc.BuildStep(command, packageBuildDir); err != nil {
-			log.Fatal(err)
+	}
+	db.Close()
+	// The built packages are installed, they must be signed
+	if getSigningKey() == nil && !buildInsecure {
+		log.Fatalf("No signingKey in config, the built packages could not be installed: run 'mypkg key generate' or use --insecure\n")
+	}
+	// one install at a time
+	var installLock sync.Mutex
+	results, err := mpkg.Schedule(descs, buildJobs, buildKeepGoing, func(desc *mpkg.PackageDesc) error {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		// Install
-		if err := packageDesc.InstallStep(command, packageBuildDir); err != nil {
-			log.Fatal(err)
+		log.Infof("Building %v\n", desc.GetFullName())
+		b := newBuilder(desc, getWorkDirs(desc.Name), outDir, reproducible)
+		if buildJobs > 1 {
+			b.output = &prefixWriter{prefix: "[" + desc.Name + "] ", out: os.Stdout}
 		}
-		// Prepare package file
-		pkgFullName := packageDesc.GetFullName()
-		pkgPath := filepath.Join(installDBDir, pkgFullName)
-		// Create the xml files metadata
-		if err := mpkg.CreateDirIfNotExist(pkgPath); err != nil {
-			log.Fatalln(err)
+		archives, err := b.run(ctx)
+		if err != nil {
+			log.Errorf("Could not build %v: %v\n", desc.Name, err)
+			return err
 		}
-		// write files.xml
-		if err := mpkg.WritePackageXMLFile(installDir, prefixDir); err != nil {
-			log.Fatal(err)
+		installLock.Lock()
+		defer installLock.Unlock()
+		db := openDB(false)
+		defer db.Close()
+		var changes []mpkg.HistoryChange
+		defer func() {
+			if len(changes) > 0 {
+				recordHistory(changes...)
+			}
+		}()
+		for _, archive := range archives {
+			change, err := installArchive(db, archive, "", "", buildInsecure)
+			if err != nil {
+				log.Errorf("Could not install %v: %v\n", filepath.Base(archive), err)
+				return err
+			}
+			changes = append(changes, change)
 		}
-		// Archive it
-		log.Println("Packaging...")
-		if err := packageDesc.Archive(installDir, pkgFullName, prefixDir); err != nil {
-			log.Fatal(err)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	const padding = 3
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, padding, ' ', tabwriter.TabIndent)
+	fmt.Fprintf(w, "Package\tStatus\tDuration\tError\t\n")
+	fmt.Fprintf(w, "-------\t------\t--------\t-----\t\n")
+	failed := false
+	for _, result := range results {
+		reason := ""
+		if result.Err != nil {
+			reason = result.Err.Error()
+			failed = true
 		}
-		log.Println("Cleanup...")
-		defer os.RemoveAll(installDir)
-		defer os.RemoveAll(buildDir)
-		defer os.RemoveAll(installDBDir)
-	},
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\n", result.Desc.GetFullName(), result.Status, result.Duration.Round(time.Second), reason)
+	}
+	w.Flush()
+	if failed {
+		os.Exit(1)
+	}
 }
 
+// prefixWriter writes the lines written to it in out, prefixed with prefix
+type prefixWriter struct {
+	prefix string
+	out    io.Writer
+	lock   sync.Mutex
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.buf = append(p.buf, data...)
+	for {
+		end := bytes.IndexByte(p.buf, '\n')
+		if end < 0 {
+			return len(data), nil
+		}
+		if _, err := io.WriteString(p.out, p.prefix+string(p.buf[:end+1])); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[end+1:]
+	}
+}
+
+// getBuildOwner returns the owner recorded for the packaged files:
+// --owner, owner from config or the current user, root for reproducible builds
+func getBuildOwner(reproducible bool) (mpkg.Owner, error) {
+	owner := buildOwner
+	if owner == "" {
+		owner = vcfg.GetString("owner")
+	}
+	if owner == "" && reproducible {
+		return mpkg.Owner{}, nil
+	}
+	if owner == "" {
+		return mpkg.CurrentOwner(), nil
+	}
+	return mpkg.ParseOwner(owner)
+}
+
+var buildOwner string
+var buildOutput string
+var buildSandbox bool
+var buildReproducible bool
+var buildCheckReproducible bool
+var buildJobs int
+var buildKeepGoing bool
+var buildInsecure bool
+var buildKeepBuildDir bool
+var buildCleanEnv bool
+var buildResume bool
+var buildFromStep string
+
 func init() {
 	rootCmd.AddCommand(buildCmd)
 
@@ -209,4 +818,16 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	//buildCmd.Flags().StringVar(&fileDefinition, "file", "", "The file of the tarball to build")
+	buildCmd.Flags().StringVar(&buildOutput, "output", "", "Write the package archives in this directory (default is the packages cache of cacheDir)")
+	buildCmd.Flags().BoolVar(&buildSandbox, "sandbox", false, "Run the steps in a sandbox, without network, where only buildDir and installDir are writable (default is sandbox from config)")
+	buildCmd.Flags().BoolVar(&buildReproducible, "reproducible", false, "Normalize the archives so that builds of the same recipe are identical (default is reproducible from config)")
+	buildCmd.Flags().BoolVar(&buildCheckReproducible, "check-reproducible", false, "Build twice reproducibly and report the files that differ")
+	buildCmd.Flags().IntVarP(&buildJobs, "jobs", "j", 1, "Number of packages built at the same time when building several recipes")
+	buildCmd.Flags().BoolVar(&buildKeepGoing, "keep-going", false, "Keep building the packages that do not depend on a failed one")
+	buildCmd.Flags().BoolVar(&buildInsecure, "insecure", false, "Install the packages built from several recipes even if they are not signed by a trusted key")
+	buildCmd.Flags().BoolVar(&buildCleanEnv, "clean-env", false, "Run the steps in an environment with only the variables of envAllowlist and of mypkg, and record it in the package (default is cleanEnv from config)")
+	buildCmd.Flags().BoolVar(&buildKeepBuildDir, "keep-build-dir", false, "Keep the work directories after a successful build (default is keepBuildDir from config), they are always kept after a failure")
+	buildCmd.Flags().BoolVar(&buildResume, "resume", false, "Continue the build kept in the work directories from the first step that did not complete")
+	buildCmd.Flags().StringVar(&buildFromStep, "from-step", "", "Continue the build kept in the work directories from this step: setup, build or install")
+	buildCmd.Flags().StringVar(&buildOwner, "owner", "", "Record the packaged files as owned by uid:gid or user:group, e.g. 0:0 (default is owner from config, or the current user)")
 }
@@ -0,0 +1,97 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/iisteev/mypkg/pkg/mpkg"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// cleanCmd represents the clean command
+var cleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "Remove old sources and package archives from the cache",
+	Long: `Removes files from the cache of cacheDir: the package archives in packages/
+and the downloaded sources in sources/. The archives of the installed packages
+are always kept, they are needed to roll back.
+
+With --keep N, only the N most recent versions of each package are kept (default
+is cacheKeep from config, or 3). With --not-installed, the archives of the
+versions that are not installed, and the sources of the packages that are not
+installed, are removed. The partial downloads of sources are always removed.
+--dry-run only reports what would be removed.
+
+for example:
+    mypkg clean --keep 1
+    mypkg clean --not-installed --dry-run`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		keep := cleanKeep
+		if !cmd.Flags().Changed("keep") {
+			keep = 3
+			if vcfg.IsSet("cacheKeep") {
+				keep = vcfg.GetInt("cacheKeep")
+			}
+		}
+		if keep < 0 {
+			log.Fatalf("Invalid number of versions to keep %v\n", keep)
+		}
+		db := openDB(true)
+		defer db.Close()
+		policy := mpkg.CleanPolicy{
+			Keep:         keep,
+			NotInstalled: cleanNotInstalled,
+			Installed:    map[string]mpkg.PackageID{},
+		}
+		for _, pkg := range db.Packages {
+			policy.Installed[pkg.Name] = pkg.ID()
+		}
+		removed, size, err := getCache().Clean(policy, cleanDryRun)
+		if err != nil {
+			log.Fatal(err)
+		}
+		verb := "Removed"
+		if cleanDryRun {
+			verb = "Would remove"
+		}
+		for _, file := range removed {
+			fmt.Printf("%s %s\n", verb, file.Path)
+		}
+		log.Infof("%s %d files, %s\n", verb, len(removed), mpkg.FormatSize(size))
+	},
+}
+
+var cleanKeep int
+var cleanNotInstalled bool
+var cleanDryRun bool
+
+func init() {
+	rootCmd.AddCommand(cleanCmd)
+
+	cleanCmd.Flags().IntVar(&cleanKeep, "keep", 3, "Number of versions of each package to keep, 0 keeps all of them (default is cacheKeep from config, or 3)")
+	cleanCmd.Flags().BoolVar(&cleanNotInstalled, "not-installed", false, "Remove the archives and sources of what is not installed")
+	cleanCmd.Flags().BoolVar(&cleanDryRun, "dry-run", false, "Only report the files that would be removed and the space reclaimed")
+}
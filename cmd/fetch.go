@@ -23,6 +23,7 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"context"
 	"os"
 	"path"
 	"path/filepath"
@@ -76,12 +77,19 @@ example:
 		if sha256 == "" && uri != "" {
 			pkg := &mpkg.PackageDesc{}
 			pkg.Source.URI = uri
-			base := path.Base(uri)
-			temptarball := filepath.Join("/tmp", base)
-			if err := pkg.Source.Download(temptarball); err != nil {
+			tmpDir, err := os.MkdirTemp("", "mypkg-fetch-")
+			if err != nil {
+				log.Fatal(err)
+			}
+			temptarball := filepath.Join(tmpDir, path.Base(uri))
+			// mirror:// uris are tried on each mirror
+			err = pkg.Source.DownloadIfNoCache(context.Background(), temptarball, getMirrors())
+			if err != nil {
+				os.RemoveAll(tmpDir)
 				log.Fatalf("Could not download from %v %v\n", uri, err)
 			}
 			hash, err := mpkg.GetHashString(temptarball)
+			os.RemoveAll(tmpDir)
 			if err != nil {
 				log.Fatalf("Could not get the hash of %v\n", temptarball)
 			}
@@ -0,0 +1,77 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// filesCmd represents the files command
+var filesCmd = &cobra.Command{
+	Use:   "files NAME",
+	Short: "List the files of an installed package",
+	Long: `Shows the files installed by a package with their type, as recorded in
+the database of dbDir.
+
+for example:
+    mypkg files htop
+    mypkg files --type man htop`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		db := openDB(true)
+		defer db.Close()
+		pkg, err := db.Lookup(args[0])
+		if err != nil {
+			log.Fatalf("Could not find an installed package: %v\n", err)
+		}
+		filesXML := pkg.Files
+		const padding = 3
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, padding, ' ', tabwriter.TabIndent)
+		fmt.Fprintf(w, "Type\tPath\t\n")
+		fmt.Fprintf(w, "----\t----\t\n")
+		for _, file := range filesXML.Files {
+			if filesType != "" && file.Type != filesType {
+				continue
+			}
+			path := filesXML.InstallPath(file)
+			if file.IsSymlink() {
+				path += " -> " + file.LinkTarget
+			}
+			fmt.Fprintf(w, "%s\t%s\t\n", file.Type, path)
+		}
+		w.Flush()
+	},
+}
+
+var filesType string
+
+func init() {
+	rootCmd.AddCommand(filesCmd)
+
+	filesCmd.Flags().StringVar(&filesType, "type", "", "Only show the files of this type")
+}
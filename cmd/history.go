@@ -0,0 +1,93 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/iisteev/mypkg/pkg/mpkg"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// historyCmd represents the history command
+var historyCmd = &cobra.Command{
+	Use:   "history [ID]",
+	Short: "Show the history of installs and removals",
+	Long: `Every install, removal and rollback is recorded as a transaction in the
+history of dbDir, with its date, user, command and the packages it installed,
+replaced or removed. Without argument, all the transactions are listed; with
+an ID, the changes of this transaction are shown.
+
+for example:
+    mypkg history
+    mypkg history 12`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		history, err := mpkg.ReadHistory(getDBDir())
+		if err != nil {
+			log.Fatal(err)
+		}
+		const padding = 3
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, padding, ' ', tabwriter.TabIndent)
+		if len(args) == 1 {
+			id, err := strconv.Atoi(args[0])
+			if err != nil {
+				log.Fatalf("Invalid transaction id %v\n", args[0])
+			}
+			for _, entry := range history {
+				if entry.ID != id {
+					continue
+				}
+				fmt.Fprintf(w, "Transaction\t%d\t\n", entry.ID)
+				fmt.Fprintf(w, "Date\t%s\t\n", entry.Time.Local().Format("2006-01-02 15:04:05"))
+				fmt.Fprintf(w, "User\t%s\t\n", entry.User)
+				fmt.Fprintf(w, "Command\t%s\t\n", entry.Command)
+				for _, change := range entry.Changes {
+					fmt.Fprintf(w, "\t%s\t\n", change)
+				}
+				w.Flush()
+				return
+			}
+			log.Fatalf("No transaction %d in history\n", id)
+		}
+		fmt.Fprintf(w, "ID\tDate\tUser\tChanges\t\n")
+		fmt.Fprintf(w, "--\t----\t----\t-------\t\n")
+		for _, entry := range history {
+			var changes []string
+			for _, change := range entry.Changes {
+				changes = append(changes, change.String())
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t\n", entry.ID, entry.Time.Local().Format("2006-01-02 15:04"), entry.User, strings.Join(changes, ", "))
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+}
@@ -24,10 +24,12 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 
 	"path/filepath"
-	"strings"
+	"time"
 
 	"github.com/iisteev/mypkg/pkg/mpkg"
 	log "github.com/sirupsen/logrus"
@@ -38,71 +40,208 @@ import (
 var installCmd = &cobra.Command{
 	Use:   "install",
 	Short: "Install compiled tarball",
-	Long:  `This is used to install tarball in the system`,
+	Long: `This is used to install tarball in the system.
+
+If the given tarball does not exist locally, it is looked up by name in the
+repository configured with repo (or --repo) and downloaded from it.
+
+The tarball is extracted and verified in a staging directory of dbDir, then
+its files are moved in place. Existing files that do not belong to a previous
+version of the package are conflicts, unless --force is given. If the install
+is interrupted, run 'mypkg recover' to complete or roll it back.
+
+The modes and mtimes recorded in the package are restored, as well as the
+owners when running as root.
+
+With --prefix, the package is installed in another prefix than the one it was
+built for. The build prefix is replaced in pkg-config, libtool, cmake files and
+scripts; a warning is shown for other files that hardcode it.
+
+The tarball must be signed (tarball.sig) by a key of the trust store,
+see 'mypkg key'. Use --insecure to install it anyway.
+
+for example:
+    mypkg install htop-3.0.5-1.tar.xz
+    mypkg install --repo http://buildbox:8080 htop`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) != 1 {
 			log.Fatal("Non or more than one argument provide. Accepting ONLY one argument")
 		}
 		tarball := args[0]
-		// Check if the tarball exist
+		// Check if the tarball exist, otherwise look for it in the repository
 		if mpkg.IsNotExist(tarball) {
-			log.Fatalf("Could not found tarball %v\n", tarball)
-		}
-		// Get the dbpath
-		dbdir := getKeyFromConf("dbDir")
-		// Get files.xml
-		tarxz := mpkg.GeFileBaseName(tarball)
-		fileBaseName := mpkg.GeFileBaseName(tarxz)
-		all := strings.Split(fileBaseName, "-")
-		if len(all) < 3 {
-			log.Fatalf("name not correct %v\n", fileBaseName)
+			repoURL := installRepo
+			if repoURL == "" {
+				repoURL = vcfg.GetString("repo")
+			}
+			if repoURL == "" {
+				log.Fatalf("Could not found tarball %v\n", tarball)
+			}
+			downloaded, err := fetchFromRepo(repoURL, tarball)
+			if err != nil {
+				log.Fatalf("Could not fetch %v from %v: %v\n", tarball, repoURL, err)
+			}
+			defer os.RemoveAll(filepath.Dir(downloaded))
+			tarball = downloaded
 		}
-		name := strings.Join(all[:len(all)-2], "")
-		version := all[len(all)-2]
-		release := all[len(all)-1]
-		pkg := &mpkg.PackageDesc{
-			Name:    name,
-			Version: version,
-			Release: release,
+		db := openDB(false)
+		defer db.Close()
+		reason := ""
+		if installAsDependency {
+			reason = mpkg.ReasonDependency
 		}
-		prefixDir := getKeyFromConf("prefix")
-		pkgPath := filepath.Join(dbdir, pkg.GetFullName())
-		// Verify each file hash against its hash
-		log.Printf("Installing %v\n", pkg.GetFullName())
-		if err := os.MkdirAll(pkgPath, os.ModePerm); err != nil {
+		change, err := installArchive(db, tarball, installPrefix, reason, installInsecure)
+		if err != nil {
 			log.Fatal(err)
 		}
+		recordHistory(change)
+	},
+}
 
-		if err := mpkg.Unarchive(context.Background(), tarball, "/"); err != nil {
-			log.Fatal(err)
+// installArchive installs the package archive tarball in a transaction and returns
+// the change of the installed packages. With prefix, the package is relocated in it
+// if it was built for another prefix. reason is the install reason, the one of the
+// replaced version or explicit if empty. With insecure, an invalid signature is only a warning.
+func installArchive(db *mpkg.DB, tarball, prefix, reason string, insecure bool) (mpkg.HistoryChange, error) {
+	var change mpkg.HistoryChange
+	// Verify the signature of the tarball
+	if err := verifySignature(tarball, insecure); err != nil {
+		return change, err
+	}
+	// Get the package id from the file name
+	pkg, err := mpkg.ParseArchiveName(tarball)
+	if err != nil {
+		return change, err
+	}
+	prefixDir := getKeyFromConf("prefix")
+	log.Printf("Installing %v\n", pkg)
+	tx, err := mpkg.NewTransaction(filepath.Join(getDBDir(), mpkg.TransactionDirName))
+	if errors.Is(err, mpkg.ErrPendingTransaction) {
+		return change, fmt.Errorf("%w, run 'mypkg recover' first", err)
+	}
+	if err != nil {
+		return change, err
+	}
+	// Extract in the staging directory and verify each file hash against its hash.
+	// Recorded owners can only be restored by root
+	log.Println("Verifying integrity")
+	filesXML, err := tx.Stage(context.Background(), tarball, prefixDir, os.Geteuid() == 0)
+	if err != nil {
+		os.RemoveAll(tx.Dir)
+		return change, fmt.Errorf("could not stage %v: %w", tarball, err)
+	}
+	if prefix != "" && prefix != filesXML.Prefix {
+		log.Infof("Relocating from %v to %v\n", filesXML.Prefix, prefix)
+		hardcoded, err := tx.Relocate(filesXML, prefix)
+		if err != nil {
+			os.RemoveAll(tx.Dir)
+			return change, err
 		}
-		if err := os.Rename(filepath.Join(prefixDir, "/files.xml"), filepath.Join(pkgPath, "/files.xml")); err != nil {
-			log.Fatal(err)
+		for _, fpath := range hardcoded {
+			log.Warnf("%v hardcodes the build prefix and may not work\n", fpath)
 		}
-		//Unmarchall files.xml
-		filesXML, err := mpkg.UnmarshalFilesXML(pkgPath)
-		if err != nil {
-			log.Fatalf("Could not unmarchal files.xml %v\n", err)
+	}
+	record := mpkg.InstalledPackage{
+		PackageInfo: mpkg.PackageInfo{Name: pkg.Name, Version: pkg.Version, Release: pkg.Release},
+		InstallDate: time.Now().UTC().Truncate(time.Second),
+		Reason:      mpkg.ReasonExplicit,
+	}
+	if filesXML.Info != nil {
+		if filesXML.Info.ID() != pkg {
+			os.RemoveAll(tx.Dir)
+			return change, fmt.Errorf("%v contains the package %v", tarball, filesXML.Info.ID())
 		}
-		log.Println("Verifying integrity")
-		for _, file := range filesXML.Files {
-			fpath := filepath.Join("/", file.Path)
-			hash, err := mpkg.GetHashString(fpath)
-			hash = strings.TrimSpace(hash)
-			fhash := strings.TrimSpace(file.Hash)
-			if err != nil {
-				log.Fatalf("Error getting hash %v\n", err)
-			}
-			if strings.Compare(hash, fhash) != 0 {
-				log.Printf("Hash not correct, deleting file %v\n", file.Path)
-				if err := os.Remove(fpath); err != nil {
-					log.Fatalf("Could not remove file %v\n", err)
-				}
-			}
+		record.PackageInfo = *filesXML.Info
+	}
+	// an upgrade keeps the install reason unless another one is given
+	old := db.Get(record.Name)
+	if old != nil {
+		record.Reason = old.Reason
+		// Plan replaces the record
+		copied := *old
+		old = &copied
+	}
+	if reason != "" {
+		record.Reason = reason
+	}
+	if err := tx.Plan(filesXML, record, getRootDir(), db, installForce); err != nil {
+		os.RemoveAll(tx.Dir)
+		return change, err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Errorf("Could not install %v: %v\n", pkg, err)
+		if err := tx.Rollback(); err != nil {
+			return change, fmt.Errorf("could not rollback, run 'mypkg recover' to retry: %w", err)
 		}
-	},
+		return change, errors.New("rolled back")
+	}
+	// Keep the archive to be able to roll back to this version
+	if err := getCache().AddPackage(tarball); err != nil {
+		log.Warnf("Could not cache %v: %v\n", tarball, err)
+	}
+	return mpkg.NewHistoryChange(old, &pkg), nil
 }
 
+// recordHistory appends a transaction made of changes to the history of dbDir
+func recordHistory(changes ...mpkg.HistoryChange) {
+	entry, err := mpkg.AppendHistory(getDBDir(), changes)
+	if err != nil {
+		log.Errorf("Could not record the transaction in history: %v\n", err)
+		return
+	}
+	log.Infof("Transaction %d recorded in history\n", entry.ID)
+}
+
+// fetchFromRepo downloads the package name from the repository at repoURL
+// in a temporary directory and returns the path of the archive
+func fetchFromRepo(repoURL, name string) (string, error) {
+	var trust *mpkg.TrustStore
+	if !installInsecure {
+		trust = getTrustStore()
+	}
+	repo := mpkg.NewRepository(repoURL, vcfg.GetString("repoToken"), trust)
+	index, err := repo.FetchIndex()
+	if err != nil {
+		return "", err
+	}
+	entry, err := index.Find(name)
+	if err != nil {
+		return "", err
+	}
+	tmpDir, err := os.MkdirTemp("", "mypkg-")
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(tmpDir, entry.File)
+	log.Infof("Downloading %v from %v\n", entry.File, repoURL)
+	if err := repo.Download(entry, dest); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	return dest, nil
+}
+
+// verifySignature checks that tarball is signed by a trusted key.
+// Only a warning is logged with insecure.
+func verifySignature(tarball string, insecure bool) error {
+	id, err := getTrustStore().VerifyFile(tarball)
+	if err == nil {
+		log.Infof("Signed by trusted key %v\n", id)
+		return nil
+	}
+	if insecure {
+		log.Warnf("Installing %v anyway (--insecure): %v\n", tarball, err)
+		return nil
+	}
+	return fmt.Errorf("refusing to install %v: %w (use --insecure to skip this check)", tarball, err)
+}
+
+var installRepo string
+var installInsecure bool
+var installForce bool
+var installPrefix string
+var installAsDependency bool
+
 func init() {
 	rootCmd.AddCommand(installCmd)
 
@@ -116,4 +255,9 @@ func init() {
 	// is called directly, e.g.:
 	// installCmd.Flags().StringVar(&tarball, "file", "", "the path to the tarball (required)")
 	// installCmd.MarkFlagRequired("file")
+	installCmd.Flags().StringVar(&installRepo, "repo", "", "The url of the repository to install from (default is repo from config)")
+	installCmd.Flags().StringVar(&installPrefix, "prefix", "", "Install the package in this prefix instead of the one it was built for")
+	installCmd.Flags().BoolVar(&installForce, "force", false, "Overwrite existing files not owned by the package, they are backed up during the install")
+	installCmd.Flags().BoolVar(&installAsDependency, "as-dependency", false, "Record the package as installed as a dependency of another one")
+	installCmd.Flags().BoolVar(&installInsecure, "insecure", false, "Install unsigned packages or packages signed by untrusted keys")
 }
@@ -0,0 +1,129 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/iisteev/mypkg/pkg/mpkg"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var keyOutput string
+
+// keyCmd represents the key command
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manage package signing keys",
+	Long: `Manage the signing key and the trust store of public keys.
+
+Packages are signed at build time with the private key set as signingKey in config.
+Install only accepts packages signed by a key of the trust store (keysDir in config,
+default is $HOME/.mypkg/keys).`,
+}
+
+var keyGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate a new signing key",
+	Long: `Generate a new ed25519 key pair. The private key is written in --out
+(default is signingKey from config) and the public key next to it with .pub extension.
+The public key is added to the trust store.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		keyPath := keyOutput
+		if keyPath == "" {
+			keyPath = getKeyFromConf("signingKey")
+		}
+		pub, err := mpkg.GenerateKey(keyPath)
+		if err != nil {
+			log.Fatalf("Could not generate key: %v\n", err)
+		}
+		id, err := getTrustStore().Add(pub)
+		if err != nil {
+			log.Fatalf("Could not trust key: %v\n", err)
+		}
+		log.Infof("Generated key %v in %v\n", id, keyPath)
+	},
+}
+
+var keyImportCmd = &cobra.Command{
+	Use:   "import FILE",
+	Short: "Trust a public key",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := getTrustStore().Import(args[0])
+		if err != nil {
+			log.Fatalf("Could not import %v: %v\n", args[0], err)
+		}
+		log.Infof("Imported key %v\n", id)
+	},
+}
+
+var keyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List trusted and revoked keys",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		keys, err := getTrustStore().List()
+		if err != nil {
+			log.Fatal(err)
+		}
+		const padding = 3
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, padding, ' ', tabwriter.TabIndent)
+		fmt.Fprintf(w, "Id\tStatus\t\n")
+		fmt.Fprintf(w, "--\t------\t\n")
+		for _, key := range keys {
+			status := "trusted"
+			if key.Revoked {
+				status = "revoked"
+			}
+			fmt.Fprintf(w, "%s\t%s\t\n", key.ID, status)
+		}
+		w.Flush()
+	},
+}
+
+var keyRevokeCmd = &cobra.Command{
+	Use:   "revoke ID",
+	Short: "Revoke a trusted key",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := getTrustStore().Revoke(args[0]); err != nil {
+			log.Fatalf("Could not revoke %v: %v\n", args[0], err)
+		}
+		log.Infof("Revoked key %v\n", args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keyCmd)
+	keyCmd.AddCommand(keyGenerateCmd)
+	keyCmd.AddCommand(keyImportCmd)
+	keyCmd.AddCommand(keyListCmd)
+	keyCmd.AddCommand(keyRevokeCmd)
+
+	keyGenerateCmd.Flags().StringVar(&keyOutput, "out", "", "The path of the private key (default is signingKey from config)")
+}
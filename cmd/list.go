@@ -24,12 +24,9 @@ package cmd
 
 import (
 	"fmt"
-
 	"os"
-	"strings"
 	"text/tabwriter"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
@@ -38,28 +35,18 @@ var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List installed packages",
 	Long: `Simply show the installed packages.
-Reads simply the dbDir for present folders.  Each folder is an installed package.`,
+Reads the database of dbDir, with the install date and reason of each package.`,
 
 	Run: func(cmd *cobra.Command, args []string) {
-		// Get the build directory
-		dbDir := getKeyFromConf("dbDir")
-		files, err := os.ReadDir(dbDir)
-		if err != nil {
-			log.Fatal(err)
-		}
+		db := openDB(true)
+		defer db.Close()
 		const padding = 3
 		w := tabwriter.NewWriter(os.Stdout, 0, 0, padding, ' ', tabwriter.TabIndent)
-		fmt.Fprintf(w, "Name\tVersion\tRelease\t\n")
-		fmt.Fprintf(w, "----\t-------\t-------\t\n")
-		for _, f := range files {
-			all := strings.Split(f.Name(), "-")
-			if len(all) < 3 {
-				log.Fatalf("name not correct %v\n", f.Name())
-			}
-			name := strings.Join(all[:len(all)-2], "")
-			version := all[len(all)-2]
-			release := all[len(all)-1]
-			fmt.Fprintf(w, "%s\t%s\t%s\t\n", name, version, release)
+		fmt.Fprintf(w, "Name\tVersion\tRelease\tInstalled\tReason\t\n")
+		fmt.Fprintf(w, "----\t-------\t-------\t---------\t------\t\n")
+		for _, pkg := range db.Packages {
+			installed := pkg.InstallDate.Local().Format("2006-01-02 15:04")
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t\n", pkg.Name, pkg.Version, pkg.Release, installed, pkg.Reason)
 		}
 		w.Flush()
 	},
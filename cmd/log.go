@@ -0,0 +1,119 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/iisteev/mypkg/pkg/mpkg"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// logCmd represents the log command
+var logCmd = &cobra.Command{
+	Use:   "log NAME",
+	Short: "Show the build logs of a package",
+	Long: `Shows the logs of the steps of the last build of a package, kept in logDir
+(default is $HOME/.mypkg/logs). Each line is prefixed with its time, and each
+log ends with the exit status of the step.
+
+for example:
+    mypkg log htop
+    mypkg log --step build htop
+    mypkg log --failed htop`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name := args[0]
+		if id, err := mpkg.ParsePackageID(name); err == nil && mpkg.IsNotExist(mpkg.NewBuildLogs(getLogDir(), name).Dir) {
+			name = id.Name
+		}
+		logs := mpkg.NewBuildLogs(getLogDir(), name)
+		steps := logs.Steps()
+		if len(steps) == 0 {
+			log.Fatalf("No build log of %v in %v\n", name, getLogDir())
+		}
+		if logStep != "" {
+			if !slices.Contains(mpkg.Steps, logStep) {
+				log.Fatalf("Unknown step %v, steps are %v\n", logStep, strings.Join(mpkg.Steps, ", "))
+			}
+			if !slices.Contains(steps, logStep) {
+				log.Fatalf("No log of the %v step of %v, it did not run\n", logStep, name)
+			}
+			steps = []string{logStep}
+		}
+		if logFailed {
+			var failed []string
+			for _, step := range steps {
+				ok, err := logs.Failed(step)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if ok {
+					failed = append(failed, step)
+				}
+			}
+			if len(failed) == 0 {
+				log.Infof("No failed step in the last build of %v\n", name)
+				return
+			}
+			steps = failed
+		}
+		for i, step := range steps {
+			if len(steps) > 1 {
+				if i > 0 {
+					fmt.Println()
+				}
+				fmt.Printf("==> %s <==\n", logs.Path(step))
+			}
+			if err := printFile(logs.Path(step)); err != nil {
+				log.Fatal(err)
+			}
+		}
+	},
+}
+
+// printFile copies the file fpath to stdout
+func printFile(fpath string) error {
+	file, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(os.Stdout, file)
+	return err
+}
+
+var logStep string
+var logFailed bool
+
+func init() {
+	rootCmd.AddCommand(logCmd)
+
+	logCmd.Flags().StringVar(&logStep, "step", "", "Only show the log of this step: setup, build or install")
+	logCmd.Flags().BoolVar(&logFailed, "failed", false, "Only show the log of the step that failed")
+}
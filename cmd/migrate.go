@@ -0,0 +1,97 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/iisteev/mypkg/pkg/mpkg"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrade the database to the current format",
+	Long: `Imports the packages of dbDir stored with the per package layout of older
+versions (a folder name-version-release holding files.xml) in the database, then
+rewrites the database with the current format version. Missing sizes and mtimes
+are read from the installed files, and files without type are classified.
+
+The format, xml or json, is --format or dbFormat from config (default xml).
+
+for example:
+    mypkg migrate
+    mypkg migrate --format json`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dbdir := getDBDir()
+		format := migrateFormat
+		if format == "" {
+			format = vcfg.GetString("dbFormat")
+		}
+		db, err := mpkg.OpenDB(dbdir, format)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		tx, err := mpkg.LoadTransaction(filepath.Join(dbdir, mpkg.TransactionDirName))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if tx != nil {
+			log.Fatalf("%v, run 'mypkg recover' first\n", mpkg.ErrPendingTransaction)
+		}
+		prefix := getKeyFromConf("prefix")
+		imported, err := db.ImportLegacy(getRootDir(), prefix)
+		if err != nil {
+			log.Fatalf("Could not import %v: %v\n", dbdir, err)
+		}
+		for _, pkg := range db.Packages {
+			pkg.Files.Migrate(getRootDir(), prefix)
+		}
+		if format != "" {
+			db.Format = format
+		}
+		if err := db.Save(); err != nil {
+			log.Fatalf("Could not write the database: %v\n", err)
+		}
+		for _, pkgPath := range imported {
+			log.Infof("Imported %v\n", filepath.Base(pkgPath))
+			if err := os.RemoveAll(pkgPath); err != nil {
+				log.Fatal(err)
+			}
+		}
+		log.Infof("Migrated %v packages to %v\n", len(db.Packages), db.Path())
+	},
+}
+
+var migrateFormat string
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.Flags().StringVar(&migrateFormat, "format", "", "The format of the database, xml or json (default is dbFormat from config, or xml)")
+}
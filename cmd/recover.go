@@ -0,0 +1,76 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"path/filepath"
+
+	"github.com/iisteev/mypkg/pkg/mpkg"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var recoverRollback bool
+
+// recoverCmd represents the recover command
+var recoverCmd = &cobra.Command{
+	Use:   "recover",
+	Short: "Complete or roll back an interrupted install",
+	Long: `Installs are journaled in dbDir. If one was interrupted, this command completes it
+using the files left in the staging directory, or restores the replaced files with --rollback.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dbdir := getDBDir()
+		// the transaction installs the database file, it must not be in use
+		db, err := mpkg.OpenDB(dbdir, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		tx, err := mpkg.LoadTransaction(filepath.Join(dbdir, mpkg.TransactionDirName))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if tx == nil {
+			log.Info("No interrupted transaction")
+			return
+		}
+		if recoverRollback {
+			log.Infof("Rolling back install of %v\n", tx.Journal.Package)
+			if err := tx.Rollback(); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		log.Infof("Completing install of %v\n", tx.Journal.Package)
+		if err := tx.Commit(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(recoverCmd)
+
+	recoverCmd.Flags().BoolVar(&recoverRollback, "rollback", false, "Roll back the interrupted install instead of completing it")
+}
@@ -23,9 +23,9 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/iisteev/mypkg/pkg/mpkg"
 	log "github.com/sirupsen/logrus"
@@ -36,11 +36,10 @@ import (
 var removeCmd = &cobra.Command{
 	Use:   "remove",
 	Short: "remove an installed tarball.",
-	Long: `Removes the files of the tarball based on files.xml present in the defined dbDir.
-It will look in the db directory for a folder starting with provided name which reperesent
-the tarball/package installed in dbDir.
+	Long: `Removes the files of the tarball based on its files recorded in the database of dbDir.
 
-Provide only one argument to this command. The name of the tarball is without version and release.
+Provide only one argument to this command, the name of the package, or its
+name-version-release.
 
 for example:
     mypkg remove htop`,
@@ -48,62 +47,54 @@ for example:
 		if len(args) != 1 {
 			log.Fatal("Non or more than one argument provide. Accepting ONLY one argument")
 		}
-		// Get the dbpath
-		dbdir := getKeyFromConf("dbDir")
-		prefix := getKeyFromConf("prefix")
-		var packageName string
-		// We look for in package name
-		files, err := os.ReadDir(dbdir)
+		db := openDB(false)
+		defer db.Close()
+		tx, err := mpkg.LoadTransaction(filepath.Join(getDBDir(), mpkg.TransactionDirName))
 		if err != nil {
 			log.Fatal(err)
 		}
-		for _, folder := range files {
-			if strings.HasPrefix(folder.Name(), args[0]) {
-				packageName = folder.Name()
-			}
+		if tx != nil {
+			log.Fatalf("%v, run 'mypkg recover' first\n", mpkg.ErrPendingTransaction)
 		}
-		if packageName == "" {
-			log.Fatalf("Could not find an installed package with name %v\n", args[0])
-		}
-		all := strings.Split(packageName, "-")
-		if len(all) < 3 {
-			log.Fatalf("name not correct %v\n", packageName)
-		}
-		name := strings.Join(all[:len(all)-2], "")
-		version := all[len(all)-2]
-		release := all[len(all)-1]
-		pkg := &mpkg.PackageDesc{
-			Name:    name,
-			Version: version,
-			Release: release,
-		}
-		pkgPath := filepath.Join(dbdir, pkg.GetFullName())
-		if mpkg.IsNotExist(pkgPath) {
-			log.Fatalf("Could not find any %s\n", pkgPath)
-		}
-		// Unmarchall files.xml
-		filesXML, err := mpkg.UnmarshalFilesXML(pkgPath)
-		log.Infof("Deleting files of %v\n", pkg.GetFullName())
+		// We look for the package by its exact name
+		pkg, err := db.Lookup(args[0])
 		if err != nil {
-			log.Fatalf("Could not unmarchal files.xml %v\n", err)
-		}
-		for _, file := range filesXML.Files {
-			fpath := filepath.Join("/", file.Path)
-			if err := os.Remove(fpath); err != nil {
-				log.Printf("Error deleting %v %v\n", fpath, err)
-			}
-		}
-		// delete it in db
-		if err := os.RemoveAll(pkgPath); err != nil {
-			log.Fatalf("Could not delete package file in dbDir %v", err)
+			log.Fatalf("Could not find an installed package: %v\n", err)
 		}
-		// Check for empty directory and delete it
-		if err := mpkg.DeleteEmptyFolder(prefix); err != nil {
-			log.Fatalf("Could not delete empty directories %v\n", err)
+		change, err := removePackage(db, pkg)
+		if err != nil {
+			log.Fatal(err)
 		}
+		recordHistory(change)
 	},
 }
 
+// removePackage deletes the files of pkg and its record in db
+func removePackage(db *mpkg.DB, pkg *mpkg.InstalledPackage) (mpkg.HistoryChange, error) {
+	removed := *pkg
+	change := mpkg.NewHistoryChange(&removed, nil)
+	filesXML := removed.Files
+	log.Infof("Deleting files of %v\n", removed.GetFullName())
+	for _, file := range filesXML.Files {
+		fpath := filepath.Join(getRootDir(), filesXML.InstallPath(file))
+		if err := os.Remove(fpath); err != nil {
+			log.Printf("Error deleting %v %v\n", fpath, err)
+		}
+	}
+	// delete it in db
+	db.Delete(removed.Name)
+	if err := db.Save(); err != nil {
+		return change, fmt.Errorf("could not delete package in the database %w", err)
+	}
+	// Delete the directories of the package that are now empty
+	prefix := filesXML.Prefix
+	if prefix == "" {
+		prefix = getKeyFromConf("prefix")
+	}
+	mpkg.RemoveEmptyDirs(getRootDir(), filesXML, db.Dirs(), prefix)
+	return change, nil
+}
+
 func init() {
 	rootCmd.AddCommand(removeCmd)
 
@@ -0,0 +1,122 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/iisteev/mypkg/pkg/mpkg"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// rollbackCmd represents the rollback command
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback ID",
+	Short: "Restore the installed packages as they were before a transaction",
+	Long: `Undoes the transaction ID of the history and all the later ones: the packages
+they installed are removed, and the versions they replaced or removed are
+installed again from the archives kept in the packages cache of cacheDir.
+The rollback is recorded as a new transaction.
+
+for example:
+    mypkg history
+    mypkg rollback 12`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			log.Fatalf("Invalid transaction id %v\n", args[0])
+		}
+		db := openDB(false)
+		defer db.Close()
+		history, err := mpkg.ReadHistory(getDBDir())
+		if err != nil {
+			log.Fatal(err)
+		}
+		states, err := mpkg.StateBefore(history, id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var removals []string
+		var installs []mpkg.HistoryChange
+		var missing []string
+		for _, state := range states {
+			current := db.Get(state.Name)
+			if state.From == "" {
+				if current != nil {
+					removals = append(removals, current.Name)
+				}
+				continue
+			}
+			pkg, err := state.FromID()
+			if err != nil {
+				log.Fatal(err)
+			}
+			if current != nil && current.ID() == pkg {
+				continue
+			}
+			if mpkg.IsNotExist(getCache().PackagePath(pkg)) {
+				missing = append(missing, getCache().PackagePath(pkg))
+			}
+			installs = append(installs, state)
+		}
+		if len(missing) > 0 {
+			log.Fatalf("Could not find the archives to roll back to:\n  %s\n", strings.Join(missing, "\n  "))
+		}
+		if len(removals) == 0 && len(installs) == 0 {
+			log.Info("Nothing to roll back")
+			return
+		}
+		var changes []mpkg.HistoryChange
+		// record what was done even if a step fails
+		fail := func(err error) {
+			if len(changes) > 0 {
+				recordHistory(changes...)
+			}
+			log.Fatal(err)
+		}
+		for _, name := range removals {
+			change, err := removePackage(db, db.Get(name))
+			if err != nil {
+				fail(err)
+			}
+			changes = append(changes, change)
+		}
+		for _, state := range installs {
+			pkg, _ := state.FromID()
+			change, err := installArchive(db, getCache().PackagePath(pkg), state.Prefix, "", false)
+			if err != nil {
+				fail(fmt.Errorf("could not install %v: %w", pkg, err))
+			}
+			changes = append(changes, change)
+		}
+		recordHistory(changes...)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rollbackCmd)
+}
@@ -23,9 +23,14 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/iisteev/mypkg/pkg/mpkg"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -33,8 +38,8 @@ import (
 )
 
 var cfgFile string
+var rootDir string
 var vcfg *viper.Viper
-var vsd *viper.Viper
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -60,6 +65,7 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.mypkg.yaml)")
+	rootCmd.PersistentFlags().StringVar(&rootDir, "root", "/", "install and remove packages in this directory tree instead of /")
 
 	vcfg = viper.New()
 	// Cobra also supports local flags, which will only run
@@ -68,6 +74,10 @@ func init() {
 	rootCmd.AddCommand(completionCmd)
 }
 
+// envKeyReplacer maps the keys to the environment variables overriding them.
+// SHELL is the login shell of the user, MYPKG_SHELL overrides the build shell.
+var envKeyReplacer = strings.NewReplacer("SHELL", "MYPKG_SHELL")
+
 func getKeyFromConf(key string) string {
 	skey := vcfg.GetString(key)
 	if skey == "" {
@@ -76,6 +86,97 @@ func getKeyFromConf(key string) string {
 	return skey
 }
 
+// getRootDir returns the absolute path of the directory packages are installed in
+func getRootDir() string {
+	root, err := filepath.Abs(rootDir)
+	cobra.CheckErr(err)
+	return root
+}
+
+// getDBDir returns the dbDir of config inside the install root
+func getDBDir() string {
+	return filepath.Join(getRootDir(), getKeyFromConf("dbDir"))
+}
+
+// getCache returns the cache of sources and archives, cacheDir from config or $HOME/.mypkg/cache
+func getCache() *mpkg.Cache {
+	home, err := os.UserHomeDir()
+	cobra.CheckErr(err)
+	return mpkg.NewCache(getKeyFromConfOrDefault("cacheDir", filepath.Join(home, ".mypkg", "cache")))
+}
+
+// getLogDir returns the directory of the build logs, logDir from config or $HOME/.mypkg/logs
+func getLogDir() string {
+	home, err := os.UserHomeDir()
+	cobra.CheckErr(err)
+	return getKeyFromConfOrDefault("logDir", filepath.Join(home, ".mypkg", "logs"))
+}
+
+// openDB opens the database of dbDir, for reading only if readOnly.
+// Databases still using the per package layout must be imported first.
+func openDB(readOnly bool) *mpkg.DB {
+	dbdir := getDBDir()
+	legacy, err := mpkg.LegacyPackages(dbdir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(legacy) > 0 {
+		log.Fatalf("%v uses the per package layout of older versions, run 'mypkg migrate' to import it\n", dbdir)
+	}
+	var db *mpkg.DB
+	if readOnly {
+		db, err = mpkg.ReadDB(dbdir)
+	} else {
+		db, err = mpkg.OpenDB(dbdir, vcfg.GetString("dbFormat"))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+// getKeyFromConfOrDefault returns the value of key in config or def if not set
+func getKeyFromConfOrDefault(key, def string) string {
+	skey := vcfg.GetString(key)
+	if skey == "" {
+		return def
+	}
+	return skey
+}
+
+// getMirrors returns the mirrors of config, added to the default ones
+func getMirrors() mpkg.Mirrors {
+	mirrors := mpkg.Mirrors{}
+	for name, urls := range mpkg.DefaultMirrors {
+		mirrors[name] = urls
+	}
+	for name, urls := range vcfg.GetStringMapStringSlice("mirrors") {
+		mirrors[name] = urls
+	}
+	return mirrors
+}
+
+// getTrustStore returns the trust store of public keys allowed to sign packages.
+// Default directory is $HOME/.mypkg/keys
+func getTrustStore() *mpkg.TrustStore {
+	home, err := os.UserHomeDir()
+	cobra.CheckErr(err)
+	return mpkg.NewTrustStore(getKeyFromConfOrDefault("keysDir", filepath.Join(home, ".mypkg", "keys")))
+}
+
+// getSigningKey reads the private key from signingKey in config, nil if not configured
+func getSigningKey() ed25519.PrivateKey {
+	keyPath := vcfg.GetString("signingKey")
+	if keyPath == "" {
+		return nil
+	}
+	key, err := mpkg.ReadPrivateKey(keyPath)
+	if err != nil {
+		log.Fatalf("Could not read signing key %v: %v\n", keyPath, err)
+	}
+	return key
+}
+
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	if cfgFile != "" {
@@ -92,6 +193,7 @@ func initConfig() {
 	}
 
 	vcfg.AutomaticEnv() // read in environment variables that match
+	vcfg.SetEnvKeyReplacer(envKeyReplacer)
 
 	// If a config file is found, read it in.
 	if err := vcfg.ReadInConfig(); err == nil {
@@ -0,0 +1,84 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"net/http"
+
+	"github.com/iisteev/mypkg/pkg/mpkg"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var serveDir string
+var serveAddr string
+var serveToken string
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Publish a directory of packages over http",
+	Long: `Serves the packages found in a directory and their index over http.
+
+The index (index.xml) is generated from the archives present in the directory and
+refreshed on each request. Packages can then be installed from other machines
+by setting the repository url in their configuration, or with --repo.
+
+If a token is given, clients must send it as a bearer token (repoToken in config).
+If signingKey is set in config, the index is signed with it (index.xml.sig).
+
+example:
+    mypkg serve --dir /srv/mypkg --addr :8080 --token secret`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if serveDir == "" {
+			log.Fatal("No directory provided")
+		}
+		if mpkg.IsNotExist(serveDir) {
+			log.Fatalf("Could not find directory %v\n", serveDir)
+		}
+		if serveToken == "" {
+			serveToken = vcfg.GetString("repoToken")
+		}
+		signingKey := getSigningKey()
+		if signingKey == nil {
+			log.Warn("No signingKey in config, the index will not be signed")
+		}
+		server := mpkg.NewRepoServer(serveDir, serveToken, signingKey)
+		index, err := server.Index()
+		if err != nil {
+			log.Fatalf("Could not create index of %v: %v\n", serveDir, err)
+		}
+		log.Infof("Serving %d packages from %v on %v\n", len(index.Packages), serveDir, serveAddr)
+		if err := http.ListenAndServe(serveAddr, server); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+
+	serveCmd.Flags().StringVar(&serveDir, "dir", "", "The directory containing the packages to serve")
+	serveCmd.Flags().StringVar(&serveAddr, "addr", ":8080", "The address to listen on")
+	serveCmd.Flags().StringVar(&serveToken, "token", "", "The token clients must provide (default is repoToken from config)")
+}
@@ -0,0 +1,80 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package cmd
+
+import (
+	"github.com/iisteev/mypkg/pkg/mpkg"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify [NAME]",
+	Short: "Verify the files of installed packages",
+	Long: `Checks the hash of every file installed by a package, and the target of its
+symbolic links, against the database of dbDir. Without argument, every
+installed package is verified. With --type, only the files of this type are
+verified, e.g. config files.
+
+for example:
+    mypkg verify htop`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		db := openDB(true)
+		defer db.Close()
+		packages := db.Packages
+		if len(args) == 1 {
+			pkg, err := db.Lookup(args[0])
+			if err != nil {
+				log.Fatalf("Could not find an installed package: %v\n", err)
+			}
+			packages = []mpkg.InstalledPackage{*pkg}
+		}
+		failed := false
+		for _, pkg := range packages {
+			filesXML := pkg.Files
+			for _, file := range filesXML.Files {
+				if verifyType != "" && file.Type != verifyType {
+					continue
+				}
+				if err := filesXML.VerifyFile(getRootDir(), file); err != nil {
+					log.Errorf("%v: %v file: %v\n", pkg.GetFullName(), file.Type, err)
+					failed = true
+				}
+			}
+		}
+		if failed {
+			log.Fatal("Verification failed")
+		}
+		log.Info("All files OK")
+	},
+}
+
+var verifyType string
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().StringVar(&verifyType, "type", "", "Only verify the files of this type")
+}
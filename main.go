@@ -21,8 +21,13 @@ THE SOFTWARE.
 */
 package main
 
-import "github.com/iisteev/mypkg/cmd"
+import (
+	"github.com/iisteev/mypkg/cmd"
+	"github.com/iisteev/mypkg/pkg/mpkg"
+)
 
 func main() {
+	// Builds run in a sandbox run mypkg again as its helper
+	mpkg.SandboxInit()
 	cmd.Execute()
 }
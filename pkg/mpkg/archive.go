@@ -1,10 +1,12 @@
 package mpkg
 
 import (
+	"archive/tar"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -31,6 +33,19 @@ var archivals = map[string]archives.Archival{
 }
 
 func ArchiveFiles(ctx context.Context, dir string, dst string, filenames map[string]string, archival string, compression string) error {
+	if IsNotExist(dir) {
+		return fmt.Errorf("no such directory %s", dir)
+	}
+
+	files, err := archives.FilesFromDisk(ctx, &archives.FromDiskOptions{FollowSymlinks: false}, filenames)
+	if err != nil {
+		return fmt.Errorf("unable to map files to directory: %w", err)
+	}
+	return WriteArchive(ctx, dst, files, archival, compression)
+}
+
+// WriteArchive creates dst archive with the given files
+func WriteArchive(ctx context.Context, dst string, files []archives.FileInfo, archival string, compression string) error {
 	com := compressions[compression]
 	if com == nil {
 		return fmt.Errorf("unsupported compression %s", compression)
@@ -39,19 +54,10 @@ func ArchiveFiles(ctx context.Context, dir string, dst string, filenames map[str
 	if archiv == nil {
 		return fmt.Errorf("unsupported archival %s", archival)
 	}
-
-	if IsNotExist(dir) {
-		return fmt.Errorf("no such directory %s", dir)
-	}
 	if !IsNotExist(dst) {
 		return fmt.Errorf("%s already exists", dst)
 	}
 
-	files, err := archives.FilesFromDisk(ctx, &archives.FromDiskOptions{FollowSymlinks: true}, filenames)
-	if err != nil {
-		return fmt.Errorf("unable to map files to directory: %w", err)
-	}
-
 	logrus.Infof("Creating package file %s", dst)
 	dstf, err := os.Create(dst)
 	if err != nil {
@@ -63,14 +69,30 @@ func ArchiveFiles(ctx context.Context, dir string, dst string, filenames map[str
 		Archival:    archiv,
 	}
 
-	err = format.Archive(ctx, dstf, files)
-	if err != nil {
+	if err := format.Archive(ctx, dstf, files); err != nil {
 		return fmt.Errorf("unable to archive: %w", err)
 	}
 
 	return nil
 }
 
+// hardlinkInfo makes the tar writer store a file as a hard link to target
+type hardlinkInfo struct {
+	fs.FileInfo
+	target string
+}
+
+func (h hardlinkInfo) Sys() any {
+	return &tar.Header{Typeflag: tar.TypeLink, Linkname: h.target}
+}
+
+// AsHardlink returns file archived as a hard link to target, a name in the archive
+func AsHardlink(file archives.FileInfo, target string) archives.FileInfo {
+	file.FileInfo = hardlinkInfo{FileInfo: file.FileInfo, target: target}
+	file.LinkTarget = target
+	return file
+}
+
 func Archive(ctx context.Context, dir string, dst string, archival string, compression string) error {
 	baseDirName := filepath.Base(filepath.Clean(dir))
 	if dir == "." {
@@ -81,6 +103,16 @@ func Archive(ctx context.Context, dir string, dst string, archival string, compr
 
 // Unarchive unpacks the given compressed file to destination
 func Unarchive(ctx context.Context, filepath string, dest string) error {
+	return unarchive(ctx, filepath, dest, false)
+}
+
+// UnarchiveInRoot unpacks a package to dest, which stands for the root it is installed in.
+// Absolute link targets are resolved in dest and must not escape it.
+func UnarchiveInRoot(ctx context.Context, filepath string, dest string) error {
+	return unarchive(ctx, filepath, dest, true)
+}
+
+func unarchive(ctx context.Context, filepath string, dest string, inRoot bool) error {
 	archivef, err := os.Open(filepath)
 	if err != nil {
 		return fmt.Errorf("error while opening file: %w", err)
@@ -97,7 +129,7 @@ func Unarchive(ctx context.Context, filepath string, dest string) error {
 	}
 
 	handler := func(ctx context.Context, f archives.FileInfo) error {
-		return handleArchivedFile(f, dest)
+		return handleArchivedFile(f, dest, inRoot)
 	}
 	err = extractor.Extract(ctx, input, handler)
 	if err != nil {
@@ -107,14 +139,18 @@ func Unarchive(ctx context.Context, filepath string, dest string) error {
 }
 
 // Borrowed from https://github.com/jm33-m0/arc/blob/main/v2/unarchiver.go
-func handleArchivedFile(file archives.FileInfo, dest string) error {
+func handleArchivedFile(file archives.FileInfo, dest string, inRoot bool) error {
 	dstPath, err := SecurePath(dest, file.NameInArchive)
 	if err != nil {
 		return err
 	}
 
 	parentDir := filepath.Dir(dstPath)
-	if err := CreateDirWithPerm(parentDir, 0o700); err != nil {
+	// do not write through a symlink extracted previously
+	if err := checkNoSymlinkInPath(dest, parentDir); err != nil {
+		return err
+	}
+	if err := CreateDirWithPerm(parentDir, 0o755); err != nil {
 		return fmt.Errorf("mkdir %s: %w", parentDir, err)
 	}
 
@@ -122,9 +158,26 @@ func handleArchivedFile(file archives.FileInfo, dest string) error {
 		return CreateDirWithPerm(dstPath, file.Mode())
 	}
 
-	// TODO: Handle symlinks without dereferencing it
+	if file.Mode()&os.ModeSymlink != 0 {
+		if err := checkLinkTarget(dest, dstPath, file.LinkTarget, inRoot); err != nil {
+			return err
+		}
+		if err := os.Remove(dstPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Symlink(file.LinkTarget, dstPath)
+	}
+
+	// Hard link to a file extracted previously
 	if file.LinkTarget != "" {
-		return nil
+		targetPath, err := SecurePath(dest, file.LinkTarget)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(dstPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Link(targetPath, dstPath)
 	}
 
 	originMode, err := os.Stat(parentDir)
@@ -155,7 +208,44 @@ func handleArchivedFile(file archives.FileInfo, dest string) error {
 	if _, err := io.Copy(dstFile, reader); err != nil {
 		return fmt.Errorf("error while copying archive file: %w", err)
 	}
+	if err := dstFile.Close(); err != nil {
+		return err
+	}
 
+	return os.Chtimes(dstPath, file.ModTime(), file.ModTime())
+}
+
+// checkLinkTarget rejects relative link targets escaping dest.
+// Absolute targets are only checked, resolved in dest, if dest stands for a root.
+func checkLinkTarget(dest, link, target string, inRoot bool) error {
+	resolved := filepath.Join(filepath.Dir(link), target)
+	if filepath.IsAbs(target) {
+		if !inRoot {
+			return nil
+		}
+		resolved = filepath.Join(dest, target)
+	}
+	if resolved != filepath.Clean(dest) && !strings.HasPrefix(resolved, filepath.Clean(dest)+string(os.PathSeparator)) {
+		return fmt.Errorf("illegal link target: %s -> %s", link, target)
+	}
+	return nil
+}
+
+// checkNoSymlinkInPath returns an error if a directory of path, within dest, is a symlink
+func checkNoSymlinkInPath(dest, path string) error {
+	dest = filepath.Clean(dest)
+	for dir := filepath.Clean(path); dir != dest && strings.HasPrefix(dir, dest); dir = filepath.Dir(dir) {
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("illegal file path through symlink: %s", dir)
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,193 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package mpkg
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Steps of a build, in order
+const (
+	StepSetup   = "setup"
+	StepBuild   = "build"
+	StepInstall = "install"
+)
+
+// Steps are the steps of a build, in order
+var Steps = []string{StepSetup, StepBuild, StepInstall}
+
+// LogExt is the extension of the log files of the steps
+const LogExt = ".log"
+
+// Markers of the last line of a step log
+const (
+	logSucceeded = "# succeeded"
+	logFailed    = "# failed"
+)
+
+// BuildLogs holds the logs of the steps of the last build of a package, one file per step
+type BuildLogs struct {
+	Dir string
+}
+
+// NewBuildLogs returns the logs of the package name in logDir
+func NewBuildLogs(logDir, name string) *BuildLogs {
+	return &BuildLogs{Dir: filepath.Join(logDir, name)}
+}
+
+// Path returns the path of the log of step
+func (l *BuildLogs) Path(step string) string {
+	return filepath.Join(l.Dir, step+LogExt)
+}
+
+// Reset removes the logs of a previous build
+func (l *BuildLogs) Reset() error {
+	if err := os.RemoveAll(l.Dir); err != nil {
+		return err
+	}
+	return CreateDirIfNotExist(l.Dir)
+}
+
+// Start creates the log of step of the package id
+func (l *BuildLogs) Start(id PackageID, step string) (*StepLog, error) {
+	file, err := os.Create(l.Path(step))
+	if err != nil {
+		return nil, err
+	}
+	stepLog := &StepLog{Path: file.Name(), file: file, start: time.Now()}
+	fmt.Fprintf(file, "# %s step of %s, started %s\n", step, id, stepLog.start.Format(time.RFC3339))
+	return stepLog, nil
+}
+
+// Steps returns the steps having a log, in order
+func (l *BuildLogs) Steps() []string {
+	var steps []string
+	for _, step := range Steps {
+		if !IsNotExist(l.Path(step)) {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+// Failed checks if the log of step ends with a failure
+func (l *BuildLogs) Failed(step string) (bool, error) {
+	lines, err := TailFile(l.Path(step), 1)
+	if err != nil {
+		return false, err
+	}
+	return len(lines) == 1 && strings.HasPrefix(lines[0], logFailed), nil
+}
+
+// StepLog is the log of a step. Each line written to it is prefixed with the time.
+type StepLog struct {
+	Path  string
+	file  *os.File
+	start time.Time
+	lock  sync.Mutex
+	buf   []byte
+}
+
+func (s *StepLog) Write(data []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.buf = append(s.buf, data...)
+	for {
+		end := bytes.IndexByte(s.buf, '\n')
+		if end < 0 {
+			return len(data), nil
+		}
+		if err := s.writeLine(string(s.buf[:end])); err != nil {
+			return 0, err
+		}
+		s.buf = s.buf[end+1:]
+	}
+}
+
+func (s *StepLog) writeLine(line string) error {
+	_, err := fmt.Fprintf(s.file, "%s %s\n", time.Now().Format("15:04:05.000"), line)
+	return err
+}
+
+// flush writes the last line if it has no newline
+func (s *StepLog) flush() {
+	if len(s.buf) > 0 {
+		s.writeLine(string(s.buf))
+		s.buf = nil
+	}
+}
+
+// Results writes the exit status and duration of each command of the step
+func (s *StepLog) Results(results []CommandResult) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.flush()
+	for i, result := range results {
+		fmt.Fprintf(s.file, "# line %d, exit status %d in %v: %s\n", i+1, result.ExitCode, result.Duration.Round(time.Millisecond), result.Summary())
+	}
+}
+
+// Close ends the log with the outcome of the step, err being the error it returned
+func (s *StepLog) Close(err error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.flush()
+	duration := time.Since(s.start).Round(time.Millisecond)
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		fmt.Fprintf(s.file, "%s in %v, exit status 0\n", logSucceeded, duration)
+	case errors.As(err, &exitErr):
+		fmt.Fprintf(s.file, "%s in %v, exit status %d\n", logFailed, duration, exitErr.ExitCode())
+	default:
+		fmt.Fprintf(s.file, "%s in %v: %v\n", logFailed, duration, err)
+	}
+	return s.file.Close()
+}
+
+// TailFile returns the last n lines of the file fpath
+func TailFile(fpath string, n int) ([]string, error) {
+	file, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,85 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package mpkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// BuildStateName is the file recording the progress of a build in its work directories
+const BuildStateName = "build-state.json"
+
+// BuildState is the progress of a build, to resume it
+type BuildState struct {
+	// Package is the name-version-release of the package built
+	Package string `json:"package"`
+	// SourceDir is the directory the source was unpacked in, where the steps run
+	SourceDir string `json:"sourceDir"`
+	// Completed are the steps that succeeded
+	Completed []string `json:"completed"`
+}
+
+// LoadBuildState reads the state saved in dir, it returns nil if there is none
+func LoadBuildState(dir string) (*BuildState, error) {
+	data, err := os.ReadFile(filepath.Join(dir, BuildStateName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state BuildState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid build state in %s: %w", dir, err)
+	}
+	return &state, nil
+}
+
+// Save writes the state in dir
+func (s *BuildState) Save(dir string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, BuildStateName), data, 0o644)
+}
+
+// Complete records that step succeeded
+func (s *BuildState) Complete(step string) {
+	if !slices.Contains(s.Completed, step) {
+		s.Completed = append(s.Completed, step)
+	}
+}
+
+// NextStep returns the first step that did not complete, or an empty string if all did
+func (s *BuildState) NextStep() string {
+	for _, step := range Steps {
+		if !slices.Contains(s.Completed, step) {
+			return step
+		}
+	}
+	return ""
+}
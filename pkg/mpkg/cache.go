@@ -0,0 +1,247 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package mpkg
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Cache is the directory keeping the downloaded sources, in sources/<name>/,
+// and the built or installed package archives, in packages/
+type Cache struct {
+	Dir string
+}
+
+// NewCache returns the cache kept in dir
+func NewCache(dir string) *Cache {
+	return &Cache{Dir: dir}
+}
+
+// SourcesDir returns the directory of the sources of the package name
+func (c *Cache) SourcesDir(name string) string {
+	return filepath.Join(c.Dir, "sources", name)
+}
+
+// SourcePath returns the path of the source at uri of the package name
+func (c *Cache) SourcePath(name, uri string) string {
+	base := path.Base(uri)
+	if u, err := url.Parse(uri); err == nil {
+		base = path.Base(u.Path)
+	}
+	return filepath.Join(c.SourcesDir(name), base)
+}
+
+// PackagesDir returns the directory of the package archives
+func (c *Cache) PackagesDir() string {
+	return filepath.Join(c.Dir, "packages")
+}
+
+// PackagePath returns the path of the archive of the package id
+func (c *Cache) PackagePath(id PackageID) string {
+	return filepath.Join(c.PackagesDir(), id.ArchiveName())
+}
+
+// AddPackage copies the archive tarball, and its signature, in the cache
+func (c *Cache) AddPackage(tarball string) error {
+	dest := filepath.Join(c.PackagesDir(), filepath.Base(tarball))
+	if same, err := SameFile(tarball, dest); err == nil && same {
+		return nil
+	}
+	if err := CreateDirIfNotExist(c.PackagesDir()); err != nil {
+		return err
+	}
+	if err := CopyFile(tarball, dest); err != nil {
+		return err
+	}
+	if IsNotExist(tarball + SignatureExt) {
+		return nil
+	}
+	return CopyFile(tarball+SignatureExt, dest+SignatureExt)
+}
+
+// CleanPolicy selects the files removed from the cache. The archives of the
+// installed packages are always kept.
+type CleanPolicy struct {
+	// Keep is the number of versions kept for each package, the most recent
+	// ones; 0 keeps all of them
+	Keep int
+	// NotInstalled removes the archives and sources of the packages, or
+	// versions, that are not installed
+	NotInstalled bool
+	// Installed is the installed version of the packages, by name
+	Installed map[string]PackageID
+}
+
+// CachedFile is a file of the cache
+type CachedFile struct {
+	Path string
+	Size int64
+}
+
+// Clean removes the files of the cache selected by policy, and returns them
+// with the space reclaimed. With dryRun, nothing is removed.
+func (c *Cache) Clean(policy CleanPolicy, dryRun bool) ([]CachedFile, int64, error) {
+	packages, err := c.cleanPackages(policy)
+	if err != nil {
+		return nil, 0, err
+	}
+	sources, err := c.cleanSources(policy)
+	if err != nil {
+		return nil, 0, err
+	}
+	removed := append(packages, sources...)
+	var size int64
+	for _, file := range removed {
+		size += file.Size
+		if dryRun {
+			continue
+		}
+		if err := os.Remove(file.Path); err != nil && !os.IsNotExist(err) {
+			return nil, 0, err
+		}
+	}
+	if !dryRun {
+		removeEmptySourceDirs(filepath.Join(c.Dir, "sources"))
+	}
+	return removed, size, nil
+}
+
+// cachedVersion is an archive, or the sources, of a version of a package
+type cachedVersion struct {
+	id    PackageID
+	files []CachedFile
+	mtime int64
+}
+
+func (c *Cache) cleanPackages(policy CleanPolicy) ([]CachedFile, error) {
+	entries, err := os.ReadDir(c.PackagesDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string][]*cachedVersion{}
+	for _, entry := range entries {
+		id, err := ParseArchiveName(entry.Name())
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		fpath := filepath.Join(c.PackagesDir(), entry.Name())
+		version := &cachedVersion{
+			id:    id,
+			files: []CachedFile{{Path: fpath, Size: info.Size()}},
+			mtime: info.ModTime().UnixNano(),
+		}
+		if sig, err := os.Stat(fpath + SignatureExt); err == nil {
+			version.files = append(version.files, CachedFile{Path: fpath + SignatureExt, Size: sig.Size()})
+		}
+		byName[id.Name] = append(byName[id.Name], version)
+	}
+	var removed []CachedFile
+	for name, versions := range byName {
+		installed, isInstalled := policy.Installed[name]
+		// most recent first
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].mtime > versions[j].mtime
+		})
+		for idx, version := range versions {
+			if isInstalled && version.id == installed {
+				continue
+			}
+			if policy.NotInstalled || (policy.Keep > 0 && idx >= policy.Keep) {
+				removed = append(removed, version.files...)
+			}
+		}
+	}
+	return removed, nil
+}
+
+func (c *Cache) cleanSources(policy CleanPolicy) ([]CachedFile, error) {
+	sourcesDir := filepath.Join(c.Dir, "sources")
+	names, err := os.ReadDir(sourcesDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var removed []CachedFile
+	for _, name := range names {
+		if !name.IsDir() {
+			continue
+		}
+		_, isInstalled := policy.Installed[name.Name()]
+		entries, err := os.ReadDir(filepath.Join(sourcesDir, name.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var files []*cachedVersion
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			fpath := filepath.Join(sourcesDir, name.Name(), entry.Name())
+			// interrupted downloads
+			if strings.HasSuffix(entry.Name(), PartExt) {
+				removed = append(removed, CachedFile{Path: fpath, Size: info.Size()})
+				continue
+			}
+			files = append(files, &cachedVersion{
+				files: []CachedFile{{Path: fpath, Size: info.Size()}},
+				mtime: info.ModTime().UnixNano(),
+			})
+		}
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].mtime > files[j].mtime
+		})
+		for idx, file := range files {
+			if (policy.NotInstalled && !isInstalled) || (policy.Keep > 0 && idx >= policy.Keep) {
+				removed = append(removed, file.files...)
+			}
+		}
+	}
+	return removed, nil
+}
+
+func removeEmptySourceDirs(sourcesDir string) {
+	names, err := os.ReadDir(sourcesDir)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if name.IsDir() && !strings.HasPrefix(name.Name(), ".") {
+			// fails if the directory is not empty
+			_ = os.Remove(filepath.Join(sourcesDir, name.Name()))
+		}
+	}
+}
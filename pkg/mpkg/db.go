@@ -0,0 +1,425 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package mpkg
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DBFormatVersion is the version of the database format written by mypkg
+const DBFormatVersion = 1
+
+const (
+	// DBXMLName is the name of the database file in dbDir, with the xml format
+	DBXMLName = "installed.xml"
+	// DBJSONName is the name of the database file in dbDir, with the json format
+	DBJSONName = "installed.json"
+	dbLockName = ".lock"
+	// dbFileMode lets the users that can not install read the database
+	dbFileMode = 0o644
+)
+
+// Install reasons
+const (
+	ReasonExplicit   = "explicit"
+	ReasonDependency = "dependency"
+)
+
+// PackageInfo is the metadata of a package, recorded in its files.xml
+type PackageInfo struct {
+	Name        string `xml:"Name" json:"name"`
+	Version     string `xml:"Version" json:"version"`
+	Release     string `xml:"Release" json:"release"`
+	Summary     string `xml:"Summary,omitempty" json:"summary,omitempty"`
+	Description string `xml:"Description,omitempty" json:"description,omitempty"`
+	HomePage    string `xml:"HomePage,omitempty" json:"homePage,omitempty"`
+	Licence     string `xml:"Licence,omitempty" json:"licence,omitempty"`
+	// Environment is the environment of the build, when it was clean
+	Environment []string `xml:"Environment>Var,omitempty" json:"environment,omitempty"`
+}
+
+// ID returns the id of the package
+func (p *PackageInfo) ID() PackageID {
+	return PackageID{Name: p.Name, Version: p.Version, Release: p.Release}
+}
+
+// GetFullName returns the name-version-release of the package
+func (p *PackageInfo) GetFullName() string {
+	return p.ID().String()
+}
+
+// InstalledPackage is the record of an installed package in the database
+type InstalledPackage struct {
+	XMLName xml.Name `xml:"Package" json:"-"`
+	PackageInfo
+	InstallDate time.Time `xml:"InstallDate" json:"installDate"`
+	Reason      string    `xml:"Reason" json:"reason"`
+	Files       *Set      `xml:"Files" json:"files"`
+}
+
+// DB is the database of the installed packages, a single file of dbDir.
+// It is locked while open: exclusively by OpenDB, shared by ReadDB.
+type DB struct {
+	XMLName  xml.Name           `xml:"Database" json:"-"`
+	Version  int                `xml:"Version,attr" json:"version"`
+	Packages []InstalledPackage `xml:"Package" json:"packages"`
+
+	// Dir is the directory of the database
+	Dir string `xml:"-" json:"-"`
+	// Format is FormatXML or FormatJSON
+	Format string `xml:"-" json:"-"`
+
+	lock *os.File
+}
+
+// OpenDB opens the database of dir for writing. New databases are created with
+// format, FormatXML if empty. The database is locked until Close is called,
+// other mypkg processes wait for it.
+func OpenDB(dir, format string) (*DB, error) {
+	return openDB(dir, format, syscall.LOCK_EX)
+}
+
+// ReadDB opens the database of dir for reading
+func ReadDB(dir string) (*DB, error) {
+	return openDB(dir, "", syscall.LOCK_SH)
+}
+
+func openDB(dir, format string, how int) (*DB, error) {
+	if format == "" {
+		format = FormatXML
+	}
+	if format != FormatXML && format != FormatJSON {
+		return nil, fmt.Errorf("unsupported format %q, use %s or %s", format, FormatXML, FormatJSON)
+	}
+	// Reading creates nothing, the lock only needs to be readable
+	if how == syscall.LOCK_SH {
+		lock, err := os.Open(filepath.Join(dir, dbLockName))
+		if os.IsNotExist(err) {
+			// no database yet, or no mypkg writing it since it was created
+			db := &DB{Dir: dir, Format: format}
+			return db, db.load()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return lockDB(dir, format, lock, how)
+	}
+	if err := CreateDirIfNotExist(dir); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, dbLockName), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return lockDB(dir, format, lock, how)
+}
+
+// lockDB locks the database of dir with its lock file and loads it
+func lockDB(dir, format string, lock *os.File, how int) (*DB, error) {
+	err := syscall.Flock(int(lock.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		logrus.Infof("Waiting for the lock of %s held by another mypkg", dir)
+		err = syscall.Flock(int(lock.Fd()), how)
+	}
+	if err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("could not lock %s: %w", dir, err)
+	}
+	db := &DB{Dir: dir, Format: format, lock: lock}
+	if err := db.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// load reads the database file, the format of an existing file is kept
+func (db *DB) load() error {
+	for _, format := range []string{FormatJSON, FormatXML} {
+		content, err := os.ReadFile(filepath.Join(db.Dir, dbFileName(format)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if format == FormatJSON {
+			err = json.Unmarshal(content, db)
+		} else {
+			err = xml.Unmarshal(content, db)
+		}
+		if err != nil {
+			return fmt.Errorf("could not read the database of %s: %w", db.Dir, err)
+		}
+		if db.Version > DBFormatVersion {
+			return fmt.Errorf("the database of %s has format version %d, this mypkg only supports up to %d", db.Dir, db.Version, DBFormatVersion)
+		}
+		db.Format = format
+		for idx := range db.Packages {
+			files := db.Packages[idx].Files
+			if files == nil {
+				db.Packages[idx].Files = &Set{}
+			} else if _, err := upgradeSet(files, db.Path()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+func dbFileName(format string) string {
+	if format == FormatJSON {
+		return DBJSONName
+	}
+	return DBXMLName
+}
+
+// Path returns the path of the database file
+func (db *DB) Path() string {
+	return filepath.Join(db.Dir, dbFileName(db.Format))
+}
+
+// Marshal returns the content of the database file
+func (db *DB) Marshal() ([]byte, error) {
+	db.Version = DBFormatVersion
+	sort.SliceStable(db.Packages, func(i, j int) bool {
+		return db.Packages[i].Name < db.Packages[j].Name
+	})
+	for idx := range db.Packages {
+		db.Packages[idx].Files.Version = FilesFormatVersion
+	}
+	if db.Format == FormatJSON {
+		return json.MarshalIndent(db, "", "    ")
+	}
+	return xml.MarshalIndent(db, "", "    ")
+}
+
+// Save writes the database file atomically. The file of the other format, if
+// any, is removed.
+func (db *DB) Save() error {
+	content, err := db.Marshal()
+	if err != nil {
+		return fmt.Errorf("could not marchal the database: %w", err)
+	}
+	if err := WriteFileAtomic(db.Path(), content, dbFileMode); err != nil {
+		return err
+	}
+	for _, format := range []string{FormatXML, FormatJSON} {
+		if format != db.Format {
+			if err := os.Remove(filepath.Join(db.Dir, dbFileName(format))); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close releases the lock of the database
+func (db *DB) Close() error {
+	if db.lock == nil {
+		return nil
+	}
+	err := db.lock.Close()
+	db.lock = nil
+	return err
+}
+
+// Get returns the installed package named name, nil if not installed
+func (db *DB) Get(name string) *InstalledPackage {
+	for idx := range db.Packages {
+		if db.Packages[idx].Name == name {
+			return &db.Packages[idx]
+		}
+	}
+	return nil
+}
+
+// Lookup returns the installed package whose name, or name-version-release, is name.
+// It fails with ErrNotInstalled if there is none, and with an *AmbiguousError if
+// several packages match.
+func (db *DB) Lookup(name string) (*InstalledPackage, error) {
+	var found []*InstalledPackage
+	for idx := range db.Packages {
+		if db.Packages[idx].ID().Matches(name) {
+			found = append(found, &db.Packages[idx])
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("%s: %w", name, ErrNotInstalled)
+	case 1:
+		return found[0], nil
+	}
+	ambiguous := &AmbiguousError{Name: name}
+	for _, pkg := range found {
+		ambiguous.Candidates = append(ambiguous.Candidates, pkg.GetFullName())
+	}
+	return nil, ambiguous
+}
+
+// Put adds pkg to the database, replacing the installed version of the package
+func (db *DB) Put(pkg InstalledPackage) {
+	if old := db.Get(pkg.Name); old != nil {
+		*old = pkg
+		return
+	}
+	db.Packages = append(db.Packages, pkg)
+}
+
+// Delete removes the package named name from the database
+func (db *DB) Delete(name string) {
+	db.Packages = slices.DeleteFunc(db.Packages, func(pkg InstalledPackage) bool {
+		return pkg.Name == name
+	})
+}
+
+// Files returns the owner (name-version-release) of every file installed,
+// by absolute path
+func (db *DB) Files() map[string]string {
+	owners := map[string]string{}
+	for _, pkg := range db.Packages {
+		for _, file := range pkg.Files.Files {
+			owners[pkg.Files.InstallPath(file)] = pkg.GetFullName()
+		}
+	}
+	return owners
+}
+
+// Dirs returns the number of installed packages owning each directory,
+// by absolute path
+func (db *DB) Dirs() map[string]int {
+	owners := map[string]int{}
+	for _, pkg := range db.Packages {
+		for _, dir := range pkg.Files.Dirs {
+			owners[pkg.Files.DirPath(dir)]++
+		}
+	}
+	return owners
+}
+
+// LegacyPackages returns the packages of dbDir stored with the per package
+// layout of older versions: a folder name-version-release holding files.xml
+func LegacyPackages(dbDir string) ([]string, error) {
+	entries, err := os.ReadDir(dbDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var packages []string
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if IsNotExist(filepath.Join(dbDir, entry.Name(), FilesXMLName)) {
+			continue
+		}
+		packages = append(packages, entry.Name())
+	}
+	return packages, nil
+}
+
+// ImportLegacy adds the packages of the per package layout of db.Dir to the
+// database and returns their folders, to be removed once the database is saved.
+// root and prefix are used to complete the records, see Set.Migrate.
+func (db *DB) ImportLegacy(root, prefix string) ([]string, error) {
+	folders, err := LegacyPackages(db.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var imported []string
+	for _, folder := range folders {
+		id, err := ParsePackageID(folder)
+		if err != nil {
+			return nil, err
+		}
+		pkgPath := filepath.Join(db.Dir, folder)
+		filesXML, err := UnmarshalFilesXML(pkgPath)
+		if err != nil {
+			return nil, err
+		}
+		filesXML.Migrate(root, prefix)
+		installDate := time.Now()
+		if info, err := os.Stat(pkgPath); err == nil {
+			installDate = info.ModTime()
+		}
+		info := PackageInfo{Name: id.Name, Version: id.Version, Release: id.Release}
+		if filesXML.Info != nil {
+			info = *filesXML.Info
+		}
+		db.Put(InstalledPackage{
+			PackageInfo: info,
+			InstallDate: installDate.UTC().Truncate(time.Second),
+			Reason:      ReasonExplicit,
+			Files:       filesXML,
+		})
+		imported = append(imported, pkgPath)
+	}
+	return imported, nil
+}
+
+// RemoveEmptyDirs removes the directories of filesXML, relative to root, that are
+// empty and not owned by another package. For packages that do not record their
+// directories, the empty parent directories of their files inside prefix are removed.
+func RemoveEmptyDirs(root string, filesXML *Set, owners map[string]int, prefix string) {
+	var dirs []string
+	if len(filesXML.Dirs) > 0 {
+		for _, dir := range filesXML.Dirs {
+			if owners[filesXML.DirPath(dir)] == 0 {
+				dirs = append(dirs, filesXML.DirPath(dir))
+			}
+		}
+	} else {
+		seen := map[string]bool{}
+		prefix = filepath.Clean(prefix)
+		for _, file := range filesXML.Files {
+			for dir := filepath.Dir(filesXML.InstallPath(file)); strings.HasPrefix(dir, prefix+"/"); dir = filepath.Dir(dir) {
+				if !seen[dir] && owners[dir] == 0 {
+					seen[dir] = true
+					dirs = append(dirs, dir)
+				}
+			}
+		}
+	}
+	// deepest directories first
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return len(dirs[i]) > len(dirs[j])
+	})
+	for _, dir := range dirs {
+		// fails if the directory is not empty
+		_ = os.Remove(filepath.Join(root, dir))
+	}
+}
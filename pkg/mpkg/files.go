@@ -26,26 +26,106 @@ import (
 	"encoding/xml"
 	"fmt"
 	"os"
+	"os/user"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
 // File is the description of file within the archive.
 // The archive represent compiled tarball
 type File struct {
-	XMLName xml.Name `xml:"File"`
-	Path    string   `xml:"Path"`
-	Type    string   `xml:"Type"`
-	UID     int      `xml:"Uid"`
-	GID     int      `xml:"Gid"`
-	Mode    string   `xml:"Mode"`
-	Hash    string   `xml:"Hash"`
+	XMLName xml.Name `xml:"File" json:"-"`
+	Path    string   `xml:"Path" json:"path"`
+	Type    string   `xml:"Type" json:"type"`
+	UID     int      `xml:"Uid" json:"uid"`
+	GID     int      `xml:"Gid" json:"gid"`
+	Mode    string   `xml:"Mode" json:"mode"`
+	Hash    string   `xml:"Hash" json:"hash"`
+	Size    int64    `xml:"Size,omitempty" json:"size,omitempty"`
+	// MTime is the modification time in seconds since the epoch
+	MTime      int64  `xml:"MTime,omitempty" json:"mtime,omitempty"`
+	LinkTarget string `xml:"LinkTarget,omitempty" json:"linkTarget,omitempty"`
+	// HardlinkTo is the path of the file of the package this one is a hard link to
+	HardlinkTo string `xml:"HardlinkTo,omitempty" json:"hardlinkTo,omitempty"`
 }
 
-// Set is the list of file inside the compiled tarball (package)
+// IsSymlink checks if the file is a symbolic link
+func (f *File) IsSymlink() bool {
+	return f.LinkTarget != ""
+}
+
+// IsHardlink checks if the file is a hard link to another file of the package
+func (f *File) IsHardlink() bool {
+	return f.HardlinkTo != ""
+}
+
+// Dir is a directory created by the package
+type Dir struct {
+	XMLName xml.Name `xml:"Dir" json:"-"`
+	Path    string   `xml:"Path" json:"path"`
+	UID     int      `xml:"Uid" json:"uid"`
+	GID     int      `xml:"Gid" json:"gid"`
+	Mode    string   `xml:"Mode" json:"mode"`
+}
+
+// Set is the list of file inside the compiled tarball (package).
+// Paths of files are relative to Prefix, the prefix the package was built
+// or installed for, unless they are absolute.
 type Set struct {
-	XMLName xml.Name `xml:"Files"`
-	Files   []File   `xml:"File"`
+	XMLName xml.Name `xml:"Files" json:"-"`
+	// Version is the format version, FilesFormatVersion when written by this
+	// mypkg; sets written before it was recorded have version 0
+	Version int    `xml:"Version,attr,omitempty" json:"version"`
+	Prefix  string `xml:"Prefix,attr,omitempty" json:"prefix,omitempty"`
+	// Info is the metadata of the package, in packages only
+	Info  *PackageInfo `xml:"Info,omitempty" json:"info,omitempty"`
+	Files []File       `xml:"File" json:"files"`
+	Dirs  []Dir        `xml:"Dir" json:"dirs,omitempty"`
+}
+
+// FilesFormatVersion is the version of the files.xml format written by mypkg
+const FilesFormatVersion = 2
+
+// FilesXMLName is the name of the list of files of a package
+const FilesXMLName = "files.xml"
+
+// Formats of the database
+const (
+	FormatXML  = "xml"
+	FormatJSON = "json"
+)
+
+// InstallPath returns the absolute path of file
+func (s *Set) InstallPath(file File) string {
+	return s.absPath(file.Path)
+}
+
+// DirPath returns the absolute path of dir
+func (s *Set) DirPath(dir Dir) string {
+	return s.absPath(dir.Path)
+}
+
+func (s *Set) absPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join("/", s.Prefix, path)
+}
+
+// PrefixKey stands for the prefix in the keys of FileTypes and in FileTypeRule paths
+const PrefixKey = "PREFIX"
+
+// DefaultFileType is the type of the files not matching any rule
+const DefaultFileType = "data"
+
+// FileTypeRule classifies the files under Path as Type. Path starts with
+// PREFIX for paths in the prefix, or is absolute.
+type FileTypeRule struct {
+	Path string `yaml:"path"`
+	Type string `yaml:"type"`
 }
 
 // FileTypes find the type of a file based on its path
@@ -88,41 +168,277 @@ func IsPkgConfig(fpath string) bool {
 }
 
 // NewPackageFile
-func NewPackageFile(path, hash, mode, ftype string) *File {
+func NewPackageFile(path, hash, mode, ftype string, owner Owner) *File {
 	return &File{
 		Path: path,
 		Type: ftype,
-		UID:  os.Geteuid(),
-		GID:  os.Getegid(),
+		UID:  owner.UID,
+		GID:  owner.GID,
 		Mode: mode,
 		Hash: hash,
 	}
 }
 
-func (s *Set) VerifyIntegrity() error {
+// Owner is the owner recorded for the files of a package
+type Owner struct {
+	UID int
+	GID int
+}
+
+// CurrentOwner returns the effective user and group of the process
+func CurrentOwner() Owner {
+	return Owner{UID: os.Geteuid(), GID: os.Getegid()}
+}
+
+// ParseOwner parses uid[:gid] or user[:group]. If the group is not given,
+// the primary group of the user is used, a uid unknown to the system needs a gid.
+func ParseOwner(owner string) (Owner, error) {
+	name, group, hasGroup := strings.Cut(owner, ":")
+	var result Owner
+	if uid, err := strconv.Atoi(name); err == nil {
+		result.UID = uid
+		if !hasGroup {
+			u, err := user.LookupId(name)
+			if err != nil {
+				return result, fmt.Errorf("no primary group for uid %v, use uid:gid: %w", uid, err)
+			}
+			result.GID, _ = strconv.Atoi(u.Gid)
+			return result, nil
+		}
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return result, err
+		}
+		result.UID, _ = strconv.Atoi(u.Uid)
+		result.GID, _ = strconv.Atoi(u.Gid)
+	}
+	if !hasGroup {
+		return result, nil
+	}
+	if gid, err := strconv.Atoi(group); err == nil {
+		result.GID = gid
+		return result, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return result, err
+	}
+	result.GID, _ = strconv.Atoi(g.Gid)
+	return result, nil
+}
+
+// FormatMode returns the octal unix mode of a file, with setuid, setgid and sticky bits
+func FormatMode(mode os.FileMode) string {
+	unixMode := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		unixMode |= 0o4000
+	}
+	if mode&os.ModeSetgid != 0 {
+		unixMode |= 0o2000
+	}
+	if mode&os.ModeSticky != 0 {
+		unixMode |= 0o1000
+	}
+	return fmt.Sprintf("%04o", unixMode)
+}
+
+// ParseMode parses a mode formatted by FormatMode
+func ParseMode(mode string) (os.FileMode, error) {
+	unixMode, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode %q: %w", mode, err)
+	}
+	result := os.FileMode(unixMode).Perm()
+	if unixMode&0o4000 != 0 {
+		result |= os.ModeSetuid
+	}
+	if unixMode&0o2000 != 0 {
+		result |= os.ModeSetgid
+	}
+	if unixMode&0o1000 != 0 {
+		result |= os.ModeSticky
+	}
+	return result, nil
+}
+
+// ApplyAttributes sets the recorded mode of the files of the set, relative to root.
+// If chown is set, the recorded owner is also applied.
+func (s *Set) ApplyAttributes(root string, chown bool) error {
+	for _, file := range s.Files {
+		fpath := filepath.Join(root, s.InstallPath(file))
+		if file.IsSymlink() {
+			// the mode of a symlink is not used
+			if chown {
+				if err := os.Lchown(fpath, file.UID, file.GID); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := applyAttributes(fpath, file.Mode, file.UID, file.GID, chown); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyAttributes(fpath, fmode string, uid, gid int, chown bool) error {
+	// chown clears the setuid and setgid bits, so it is done first
+	if chown {
+		if err := os.Lchown(fpath, uid, gid); err != nil {
+			return err
+		}
+	}
+	mode, err := ParseMode(fmode)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(fpath, mode)
+}
+
+// VerifyIntegrity checks the hash of every file of the set, relative to root
+func (s *Set) VerifyIntegrity(root string) error {
+	for _, file := range s.Files {
+		if err := s.VerifyFile(root, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Extract moves the files of the given types from s to a new set and returns it.
+// Directories go to the set of the files they contain, directories without
+// files stay in s.
+func (s *Set) Extract(types []string) *Set {
+	extracted := &Set{Prefix: s.Prefix}
+	var kept []File
 	for _, file := range s.Files {
-		hash, err := GetHashString(file.Path)
+		if slices.Contains(types, file.Type) {
+			extracted.Files = append(extracted.Files, file)
+		} else {
+			kept = append(kept, file)
+		}
+	}
+	s.Files = kept
+	var keptDirs []Dir
+	for _, dir := range s.Dirs {
+		inExtracted := extracted.containsDir(dir)
+		if inExtracted {
+			extracted.Dirs = append(extracted.Dirs, dir)
+		}
+		if !inExtracted || s.containsDir(dir) {
+			keptDirs = append(keptDirs, dir)
+		}
+	}
+	s.Dirs = keptDirs
+	s.unlinkMissing()
+	extracted.unlinkMissing()
+	return extracted
+}
+
+// containsDir checks if a file of s is inside dir
+func (s *Set) containsDir(dir Dir) bool {
+	dirPath := s.DirPath(dir) + "/"
+	for _, file := range s.Files {
+		if strings.HasPrefix(s.InstallPath(file), dirPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// unlinkMissing turns the hard links to files that are not in s into regular files
+func (s *Set) unlinkMissing() {
+	paths := map[string]bool{}
+	for _, file := range s.Files {
+		paths[file.Path] = true
+	}
+	for idx := range s.Files {
+		if s.Files[idx].IsHardlink() && !paths[s.Files[idx].HardlinkTo] {
+			s.Files[idx].HardlinkTo = ""
+		}
+	}
+}
+
+// VerifyFile checks the hash of file, or the target of the link, relative to root
+func (s *Set) VerifyFile(root string, file File) error {
+	fpath := filepath.Join(root, s.InstallPath(file))
+	if file.IsSymlink() {
+		target, err := os.Readlink(fpath)
 		if err != nil {
 			return err
 		}
-		if hash != file.Hash {
-			return fmt.Errorf("hash mismatch, want %v, got %v", file.Hash, hash)
+		if target != file.LinkTarget {
+			return fmt.Errorf("link target mismatch of %v, want %v, got %v", file.Path, file.LinkTarget, target)
 		}
+		return nil
+	}
+	info, err := os.Lstat(fpath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%v is not a regular file", file.Path)
+	}
+	hash, err := GetHashString(fpath)
+	if err != nil {
+		return err
+	}
+	if hash != file.Hash {
+		return fmt.Errorf("hash mismatch of %v, want %v, got %v", file.Path, file.Hash, hash)
 	}
 	return nil
 }
 
-func CreatePackageXMLFile(rootPath, prefix string) (*Set, error) {
-	container := &Set{}
-	xmlFiles := container.Files
+// CreatePackageXMLFile lists the files installed in rootPath.
+// Paths of the files installed in prefix are stored relative to it.
+// Files are classified with GetFileType and the given rules.
+func CreatePackageXMLFile(rootPath, prefix string, owner Owner, rules []FileTypeRule) (*Set, error) {
 	srootPath := rootPath
 	sprefix := prefix
 	srootPath = strings.TrimSuffix(srootPath, "/")
 	sprefix = strings.TrimSuffix(sprefix, "/")
+	container := &Set{Prefix: sprefix}
+	xmlFiles := container.Files
+	// first path seen of the files having several hard links
+	hardlinks := map[fileID]string{}
 
 	err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// Only the directories inside prefix belong to the package
+			strippedPath := strings.ReplaceAll(path, srootPath, "")
+			if relPath, ok := strings.CutPrefix(strippedPath, sprefix+"/"); ok {
+				container.Dirs = append(container.Dirs, Dir{
+					Path: relPath,
+					UID:  owner.UID,
+					GID:  owner.GID,
+					Mode: FormatMode(info.Mode()),
+				})
+			}
+			return nil
+		}
 		if !info.IsDir() {
 			strippedPath := strings.ReplaceAll(path, srootPath, "")
+			// Files outside of prefix keep their absolute path
+			relPath, ok := strings.CutPrefix(strippedPath, sprefix+"/")
+			if !ok {
+				relPath = strippedPath
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				target, err := fixSymlink(path, srootPath, sprefix)
+				if err != nil {
+					return fmt.Errorf("could not read link %s; %v", path, err)
+				}
+				filePackage := NewPackageFile(relPath, "", FormatMode(info.Mode()), GetFileType(relPath, rules...), owner)
+				filePackage.LinkTarget = target
+				filePackage.MTime = info.ModTime().Unix()
+				xmlFiles = append(xmlFiles, *filePackage)
+				return nil
+			}
 			basicPath := strings.ReplaceAll(strippedPath, sprefix, "")
 			if IsPkgConfig(basicPath) {
 				if err := UpdateLineInFile(path, srootPath, ""); err != nil {
@@ -137,10 +453,17 @@ func CreatePackageXMLFile(rootPath, prefix string) (*Set, error) {
 			if err != nil {
 				return fmt.Errorf("could not get the file; %v", err)
 			}
-			mode := fmt.Sprintf("%04o", info.Mode().Perm())
-			// Update package config
-			strippedPath = strings.TrimPrefix(strippedPath, "/")
-			filePackage := NewPackageFile(strippedPath, hash, mode, "data")
+			mode := FormatMode(info.Mode())
+			filePackage := NewPackageFile(relPath, hash, mode, GetFileType(relPath, rules...), owner)
+			filePackage.Size = info.Size()
+			filePackage.MTime = info.ModTime().Unix()
+			if id, ok := getFileID(info); ok {
+				if first, seen := hardlinks[id]; seen {
+					filePackage.HardlinkTo = first
+				} else {
+					hardlinks[id] = relPath
+				}
+			}
 			xmlFiles = append(xmlFiles, *filePackage)
 		}
 		return nil
@@ -152,25 +475,80 @@ func CreatePackageXMLFile(rootPath, prefix string) (*Set, error) {
 	return container, nil
 }
 
-func WritePackageXMLFile(rootPath, prefix string) error {
+// fileID identifies a file on disk, to find hard links
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// getFileID returns the id of a file having more than one hard link
+func getFileID(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
+
+// fixSymlink returns the target of the link path installed in rootPath.
+// Absolute targets pointing in rootPath or in prefix, e.g. created with
+// ln -s ${INSTALL_DIR}/${PREFIX}/bin/bsdtar, are made relative to the link
+// so they are valid once installed, in any prefix.
+func fixSymlink(path, rootPath, prefix string) (string, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(target) {
+		return target, nil
+	}
+	installedTarget := filepath.Join("/", strings.TrimPrefix(target, rootPath))
+	if installedTarget != prefix && !strings.HasPrefix(installedTarget, prefix+"/") {
+		if installedTarget == target {
+			return target, nil
+		}
+		// pointing in rootPath but outside of prefix, keep it absolute
+		target = installedTarget
+	} else {
+		installedLink := filepath.Join("/", strings.TrimPrefix(path, rootPath))
+		target, err = filepath.Rel(filepath.Dir(installedLink), installedTarget)
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		return "", err
+	}
+	return target, os.Symlink(target, path)
+}
+
+// WritePackageXMLFile writes the files.xml of the files installed in rootPath.
+// owner is recorded as the owner of every file.
+func WritePackageXMLFile(rootPath, prefix string, owner Owner, rules []FileTypeRule) error {
 	frootPath := filepath.Join(rootPath, prefix)
 	if err := CreateDirIfNotExist(frootPath); err != nil {
 		return err
 	}
-	container, err := CreatePackageXMLFile(rootPath, prefix)
+	container, err := CreatePackageXMLFile(rootPath, prefix, owner, rules)
 	if err != nil {
 		return err
 	}
+	return WriteFilesXML(frootPath, container)
+}
+
+// WriteFilesXML writes container in rootPath/files.xml
+func WriteFilesXML(rootPath string, container *Set) error {
+	container.Version = FilesFormatVersion
 	output, err := xml.MarshalIndent(container, "", "    ")
 	if err != nil {
 		return fmt.Errorf("could not marchal xml: %v", err)
 	}
-	fpath := filepath.Join(frootPath, "/files.xml")
+	fpath := filepath.Join(rootPath, FilesXMLName)
 	return os.WriteFile(fpath, output, os.ModePerm)
 }
 
 func UnmarshalFilesXML(rootPath string) (*Set, error) {
-	fpath := filepath.Join(rootPath, "/files.xml")
+	fpath := filepath.Join(rootPath, FilesXMLName)
 	fileContent, err := os.ReadFile(fpath)
 	if err != nil {
 		return nil, err
@@ -179,5 +557,53 @@ func UnmarshalFilesXML(rootPath string) (*Set, error) {
 	if err := xml.Unmarshal(fileContent, &pkgFiles); err != nil {
 		return nil, err
 	}
-	return &pkgFiles, nil
+	return upgradeSet(&pkgFiles, fpath)
+}
+
+// upgradeSet converts a set read from fpath to the current format
+func upgradeSet(pkgFiles *Set, fpath string) (*Set, error) {
+	if pkgFiles.Version > FilesFormatVersion {
+		return nil, fmt.Errorf("%s has format version %d, this mypkg only supports up to %d", fpath, pkgFiles.Version, FilesFormatVersion)
+	}
+	// Packages built before the prefix was recorded store paths relative to /
+	if pkgFiles.Prefix == "" {
+		for idx := range pkgFiles.Files {
+			pkgFiles.Files[idx].Path = filepath.Join("/", pkgFiles.Files[idx].Path)
+		}
+	}
+	return pkgFiles, nil
+}
+
+// Migrate upgrades the set of a package installed in root to the current
+// format: missing sizes and mtimes are read from the installed files, and
+// files without type are classified. prefix is used to classify the files of
+// sets not recording their prefix.
+func (s *Set) Migrate(root, prefix string) {
+	typePrefix := s.Prefix
+	if typePrefix == "" {
+		typePrefix = prefix
+	}
+	for idx := range s.Files {
+		file := &s.Files[idx]
+		installPath := s.InstallPath(*file)
+		if file.Type == "" || (s.Version == 0 && file.Type == DefaultFileType) {
+			relPath, ok := strings.CutPrefix(installPath, strings.TrimSuffix(typePrefix, "/")+"/")
+			if !ok {
+				relPath = installPath
+			}
+			file.Type = GetFileType(relPath)
+		}
+		if file.Size != 0 || file.MTime != 0 {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(root, installPath))
+		if err != nil {
+			continue
+		}
+		if info.Mode().IsRegular() {
+			file.Size = info.Size()
+		}
+		file.MTime = info.ModTime().Unix()
+	}
+	s.Version = FilesFormatVersion
 }
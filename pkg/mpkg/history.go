@@ -0,0 +1,206 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package mpkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HistoryFileName is the name of the history of the transactions in dbDir.
+// It is append only, with one json entry per line.
+const HistoryFileName = "history.log"
+
+// Actions of the history changes
+const (
+	ActionInstall   = "install"
+	ActionReplace   = "replace"
+	ActionReinstall = "reinstall"
+	ActionRemove    = "remove"
+)
+
+// HistoryChange is the change of one package in a transaction
+type HistoryChange struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	// From is the version-release replaced or removed, empty for an install
+	From string `json:"from,omitempty"`
+	// To is the version-release installed, empty for a removal
+	To string `json:"to,omitempty"`
+	// Prefix is the prefix From was installed in
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// NewHistoryChange returns the change from old, nil if the package was not
+// installed, to installed, nil if the package is removed
+func NewHistoryChange(old *InstalledPackage, installed *PackageID) HistoryChange {
+	var change HistoryChange
+	if old != nil {
+		change.Name = old.Name
+		change.From = old.Version + "-" + old.Release
+		change.Prefix = old.Files.Prefix
+	}
+	if installed != nil {
+		change.Name = installed.Name
+		change.To = installed.Version + "-" + installed.Release
+	}
+	switch {
+	case old == nil:
+		change.Action = ActionInstall
+	case installed == nil:
+		change.Action = ActionRemove
+	case change.From == change.To:
+		change.Action = ActionReinstall
+	default:
+		change.Action = ActionReplace
+	}
+	return change
+}
+
+// FromID returns the id of the package replaced or removed
+func (c HistoryChange) FromID() (PackageID, error) {
+	return ParsePackageID(c.Name + "-" + c.From)
+}
+
+func (c HistoryChange) String() string {
+	switch c.Action {
+	case ActionInstall:
+		return fmt.Sprintf("%s %s %s", c.Action, c.Name, c.To)
+	case ActionRemove:
+		return fmt.Sprintf("%s %s %s", c.Action, c.Name, c.From)
+	}
+	return fmt.Sprintf("%s %s %s -> %s", c.Action, c.Name, c.From, c.To)
+}
+
+// HistoryEntry is a transaction of the history
+type HistoryEntry struct {
+	ID      int             `json:"id"`
+	Time    time.Time       `json:"time"`
+	User    string          `json:"user"`
+	Command string          `json:"command"`
+	Changes []HistoryChange `json:"changes"`
+}
+
+// ReadHistory returns the transactions of the history of dbDir, oldest first
+func ReadHistory(dbDir string) ([]HistoryEntry, error) {
+	f, err := os.Open(filepath.Join(dbDir, HistoryFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var history []HistoryEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("invalid history entry %q: %w", scanner.Text(), err)
+		}
+		history = append(history, entry)
+	}
+	return history, scanner.Err()
+}
+
+// AppendHistory records a transaction made of changes by the current user
+// and command in the history of dbDir. The database must be open with OpenDB.
+func AppendHistory(dbDir string, changes []HistoryChange) (HistoryEntry, error) {
+	history, err := ReadHistory(dbDir)
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	entry := HistoryEntry{
+		ID:      1,
+		Time:    time.Now().UTC().Truncate(time.Second),
+		User:    currentUserName(),
+		Command: strings.Join(os.Args, " "),
+		Changes: changes,
+	}
+	if len(history) > 0 {
+		entry.ID = history[len(history)-1].ID + 1
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	f, err := os.OpenFile(filepath.Join(dbDir, HistoryFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, defaultFileMode)
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return HistoryEntry{}, err
+	}
+	return entry, f.Close()
+}
+
+func currentUserName() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(os.Getuid())
+}
+
+// StateBefore returns, for every package changed by the transaction id or a
+// later one, its change in the first of these transactions: From and Prefix
+// are the state of the package before the transaction id.
+func StateBefore(history []HistoryEntry, id int) ([]HistoryChange, error) {
+	found := false
+	first := map[string]HistoryChange{}
+	for _, entry := range history {
+		if entry.ID < id {
+			continue
+		}
+		if entry.ID == id {
+			found = true
+		}
+		for _, change := range entry.Changes {
+			if _, ok := first[change.Name]; !ok {
+				first[change.Name] = change
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no transaction %d in history", id)
+	}
+	changes := make([]HistoryChange, 0, len(first))
+	for _, change := range first {
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes, nil
+}
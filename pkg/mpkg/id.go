@@ -0,0 +1,175 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package mpkg
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	packageNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9+._-]*$`)
+	// versions and releases can not contain a hyphen, the separator of the id
+	packageVersionRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9+._~]*$`)
+)
+
+// ErrNotInstalled is returned when no installed package matches a name
+var ErrNotInstalled = errors.New("not installed")
+
+// PackageID identifies a package, formatted as name-version-release.
+// The name can contain hyphens, the version and the release can not.
+type PackageID struct {
+	Name    string
+	Version string
+	Release string
+}
+
+// ParsePackageID parses name-version-release
+func ParsePackageID(s string) (PackageID, error) {
+	rest, release, ok := cutLast(s, "-")
+	if !ok {
+		return PackageID{}, fmt.Errorf("invalid package id %q, want name-version-release", s)
+	}
+	name, version, ok := cutLast(rest, "-")
+	if !ok {
+		return PackageID{}, fmt.Errorf("invalid package id %q, want name-version-release", s)
+	}
+	id := PackageID{Name: name, Version: version, Release: release}
+	if err := id.Validate(); err != nil {
+		return PackageID{}, err
+	}
+	return id, nil
+}
+
+// ParseArchiveName parses the id of a package archive file name, like
+// /tmp/htop-3.0.5-1.tar.xz
+func ParseArchiveName(fileName string) (PackageID, error) {
+	base := filepath.Base(fileName)
+	s, ok := strings.CutSuffix(base, PackageExt)
+	if !ok {
+		return PackageID{}, fmt.Errorf("invalid package file name %q, want name-version-release%s", base, PackageExt)
+	}
+	return ParsePackageID(s)
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	idx := strings.LastIndex(s, sep)
+	if idx < 0 {
+		return s, "", false
+	}
+	return s[:idx], s[idx+len(sep):], true
+}
+
+// Validate checks that the parts of the id can be formatted and parsed back
+func (id PackageID) Validate() error {
+	if !packageNameRe.MatchString(id.Name) {
+		return fmt.Errorf("invalid package name %q", id.Name)
+	}
+	if !packageVersionRe.MatchString(id.Version) {
+		return fmt.Errorf("invalid version %q of %s, it can not contain a hyphen", id.Version, id.Name)
+	}
+	if !packageVersionRe.MatchString(id.Release) {
+		return fmt.Errorf("invalid release %q of %s, it can not contain a hyphen", id.Release, id.Name)
+	}
+	return nil
+}
+
+// String returns name-version-release
+func (id PackageID) String() string {
+	return fmt.Sprintf("%s-%s-%s", id.Name, id.Version, id.Release)
+}
+
+// ArchiveName returns the file name of the package archive
+func (id PackageID) ArchiveName() string {
+	return id.String() + PackageExt
+}
+
+// Matches checks if name is the name or the name-version-release of the package
+func (id PackageID) Matches(name string) bool {
+	return id.Name == name || id.String() == name
+}
+
+// Compare compares the versions, then the releases, of id and other. It
+// returns -1 if id is older, 1 if it is newer and 0 if they are the same.
+func (id PackageID) Compare(other PackageID) int {
+	if c := CompareVersions(id.Version, other.Version); c != 0 {
+		return c
+	}
+	return CompareVersions(id.Release, other.Release)
+}
+
+// CompareVersions compares the versions a and b, like 3.0.10 and 3.0.9.
+// Their runs of digits are compared as numbers, the other runs as strings.
+func CompareVersions(a, b string) int {
+	for a != "" && b != "" {
+		var partA, partB string
+		partA, a = versionPart(a)
+		partB, b = versionPart(b)
+		if isDigit(partA[0]) && isDigit(partB[0]) {
+			partA, partB = strings.TrimLeft(partA, "0"), strings.TrimLeft(partB, "0")
+			if len(partA) != len(partB) {
+				return cmpInt(len(partA), len(partB))
+			}
+		}
+		if c := strings.Compare(partA, partB); c != 0 {
+			return c
+		}
+	}
+	return cmpInt(len(a), len(b))
+}
+
+// versionPart returns the leading run of digits, or of other characters, of
+// version, and the rest
+func versionPart(version string) (string, string) {
+	end := 1
+	for end < len(version) && isDigit(version[end]) == isDigit(version[0]) {
+		end++
+	}
+	return version[:end], version[end:]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func cmpInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// AmbiguousError is returned when a name matches several packages
+type AmbiguousError struct {
+	Name       string
+	Candidates []string
+}
+
+func (e *AmbiguousError) Error() string {
+	return fmt.Sprintf("%s is ambiguous, candidates are: %s", e.Name, strings.Join(e.Candidates, ", "))
+}
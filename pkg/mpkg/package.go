@@ -23,10 +23,17 @@ package mpkg
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/mholt/archives"
+	"github.com/sirupsen/logrus"
 )
 
 type PackageDesc struct {
@@ -41,64 +48,207 @@ type PackageDesc struct {
 	Setup       []string `yaml:"setup"`
 	Build       []string `yaml:"build"`
 	Install     []string `yaml:"install"`
+	// FileTypes are classification rules added to the default ones
+	FileTypes []FileTypeRule `yaml:"fileTypes"`
+	// Split lists the sub packages made of the files of some types
+	Split []SplitPackage `yaml:"split"`
+	// Depends are the names of the packages needed to build this one
+	Depends []string `yaml:"depends"`
+	// Shell runs the commands of the steps, with its options, instead of the shell of config
+	Shell string `yaml:"shell"`
+	// Timeout is the longest duration of each step, by step name
+	Timeout map[string]time.Duration `yaml:"timeout"`
+	// Environment is the environment of the build, recorded in the package
+	Environment []string `yaml:"-" mapstructure:"-"`
+}
+
+// SplitPackage is a sub package, named name-Name, holding the files of the given types
+type SplitPackage struct {
+	Name  string   `yaml:"name"`
+	Types []string `yaml:"types"`
+}
+
+// ID returns the id of the package
+func (s *PackageDesc) ID() PackageID {
+	return PackageID{Name: s.Name, Version: s.Version, Release: s.Release}
 }
 
 func (s *PackageDesc) GetFullName() string {
-	return fmt.Sprintf("%s-%s-%s", s.Name, s.Version, s.Release)
+	return s.ID().String()
 }
 
-func (s *PackageDesc) SetupStep(shell *Shell, dir string) error {
-	steps, err := GetStepsFromMacros(s.Setup)
-	if err != nil {
-		return err
+// Info returns the metadata recorded in the package
+func (s *PackageDesc) Info() *PackageInfo {
+	return &PackageInfo{
+		Name:        s.Name,
+		Version:     s.Version,
+		Release:     s.Release,
+		Summary:     s.Summary,
+		Description: s.Description,
+		HomePage:    s.HomePage,
+		Licence:     s.Licence,
+		Environment: s.Environment,
 	}
-	return shell.Exec(dir, steps)
 }
 
-func (s *PackageDesc) BuildStep(shell *Shell, dir string) error {
-	steps, err := GetStepsFromMacros(s.Build)
-	if err != nil {
-		return err
-	}
-	return shell.Exec(dir, steps)
+// GetSplitFullName returns the name-version-release of a sub package
+func (s *PackageDesc) GetSplitFullName(split SplitPackage) string {
+	return PackageID{Name: s.Name + "-" + split.Name, Version: s.Version, Release: s.Release}.String()
 }
 
-func (s *PackageDesc) InstallStep(shell *Shell, dir string) error {
-	steps, err := GetStepsFromMacros(s.Install)
-	if err != nil {
-		return err
-	}
-	return shell.Exec(dir, steps)
+func (s *PackageDesc) SetupStep(ctx context.Context, shell *Shell, dir string) ([]CommandResult, error) {
+	return runStep(ctx, shell, StepSetup, s.Setup, dir)
+}
+
+func (s *PackageDesc) BuildStep(ctx context.Context, shell *Shell, dir string) ([]CommandResult, error) {
+	return runStep(ctx, shell, StepBuild, s.Build, dir)
+}
+
+func (s *PackageDesc) InstallStep(ctx context.Context, shell *Shell, dir string) ([]CommandResult, error) {
+	return runStep(ctx, shell, StepInstall, s.Install, dir)
 }
 
-func (s *PackageDesc) Archive(installDir, dest, prefix string) error {
-	curdir, err := filepath.Abs("./")
+// runStep runs the commands of step with shell in dir
+func runStep(ctx context.Context, shell *Shell, step string, commands []string, dir string) ([]CommandResult, error) {
+	commands, err := GetStepsFromMacros(commands)
 	if err != nil {
-		return fmt.Errorf("unable to get current directory: %w", err)
+		return nil, err
 	}
+	results, err := shell.Exec(ctx, dir, commands)
+	var commandErr *CommandError
+	if errors.As(err, &commandErr) {
+		commandErr.Step = step
+	}
+	return results, err
+}
+
+// Archive creates the package archive of installDir in outDir, and one archive
+// for each sub package of Split, and returns their paths. Existing archives of
+// the same version are replaced.
+// If key is not nil, the archives are signed with it in a detached .sig file.
+// If reproducible is not nil, the archived files are normalized with it.
+func (s *PackageDesc) Archive(installDir, outDir, prefix string, key ed25519.PrivateKey, reproducible *Reproducible) ([]string, error) {
 	frootPath := filepath.Join(installDir, prefix)
 	container, err := UnmarshalFilesXML(frootPath)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if reproducible != nil {
+		if err := reproducible.Normalize(container); err != nil {
+			return nil, err
+		}
 	}
+	outDir, err = filepath.Abs(outDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := CreateDirIfNotExist(outDir); err != nil {
+		return nil, err
+	}
+	tmpDir, err := os.MkdirTemp("", "mypkg-split-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	var archived []string
+	for _, split := range s.Split {
+		extracted := container.Extract(split.Types)
+		extracted.Info = s.Info()
+		extracted.Info.Name = s.Name + "-" + split.Name
+		if len(extracted.Files) == 0 {
+			logrus.Warnf("No file of type %v for sub package %v", strings.Join(split.Types, ", "), split.Name)
+			continue
+		}
+		dest := filepath.Join(outDir, s.GetSplitFullName(split)+PackageExt)
+		if err := archiveSet(installDir, tmpDir, dest, extracted, key, reproducible); err != nil {
+			return nil, err
+		}
+		archived = append(archived, dest)
+	}
+	container.Info = s.Info()
+	dest := filepath.Join(outDir, s.GetFullName()+PackageExt)
+	if err := archiveSet(installDir, tmpDir, dest, container, key, reproducible); err != nil {
+		return nil, err
+	}
+	return append(archived, dest), nil
+}
 
-	if err := os.Chdir(installDir); err != nil {
-		return fmt.Errorf("could not enter dir %s: %w", installDir, err)
+// archiveSet creates the archive dest of the files of container installed in installDir.
+// The files.xml of container is written in tmpDir before being archived.
+// Entries are sorted by name, and archived with the attributes of container
+// when reproducible is not nil.
+func archiveSet(installDir, tmpDir, dest string, container *Set, key ed25519.PrivateKey, reproducible *Reproducible) error {
+	for _, fpath := range []string{dest, dest + SignatureExt} {
+		if err := os.Remove(fpath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	xmlDir := filepath.Join(tmpDir, filepath.Base(dest))
+	if err := CreateDirIfNotExist(xmlDir); err != nil {
+		return err
+	}
+	if err := WriteFilesXML(xmlDir, container); err != nil {
+		return err
 	}
 	filenames := map[string]string{}
+	// name in archive of hard links -> name in archive of their target
+	hardlinks := map[string]string{}
+	// name in archive -> recorded file
+	recorded := map[string]File{}
 
 	for _, file := range container.Files {
-		fullpath := filepath.Join(installDir, file.Path)
-		filenames[fullpath] = file.Path
+		installPath := container.InstallPath(file)
+		fullpath := filepath.Join(installDir, installPath)
+		filenames[fullpath] = strings.TrimPrefix(installPath, "/")
+		recorded[filenames[fullpath]] = file
+		if file.IsHardlink() {
+			hardlinks[filenames[fullpath]] = strings.TrimPrefix(container.absPath(file.HardlinkTo), "/")
+		}
 	}
 
-	prefix, _ = strings.CutPrefix(prefix, "/")
-	filesXMLPath := filepath.Join(prefix, "files.xml")
-
-	fullpath := filepath.Join(installDir, filesXMLPath)
-	filenames[fullpath] = filesXMLPath
-
-	dest = filepath.Join(curdir, fmt.Sprintf("%s.%s.%s", dest, DefaultArchival, DefaultCompression))
+	prefix, _ := strings.CutPrefix(container.Prefix, "/")
+	xmlName := filepath.Join(prefix, "files.xml")
+	filenames[filepath.Join(xmlDir, "files.xml")] = xmlName
 
-	return ArchiveFiles(context.Background(), installDir, dest, filenames, DefaultArchival, DefaultCompression)
+	ctx := context.Background()
+	files, err := archives.FilesFromDisk(ctx, &archives.FromDiskOptions{FollowSymlinks: false}, filenames)
+	if err != nil {
+		return fmt.Errorf("unable to map files to directory: %w", err)
+	}
+	// hard links are archived after the files they point to
+	var regular, links []archives.FileInfo
+	for _, file := range files {
+		if target, ok := hardlinks[file.NameInArchive]; ok {
+			file = AsHardlink(file, target)
+		}
+		if reproducible != nil {
+			if recordedFile, ok := recorded[file.NameInArchive]; ok {
+				mode, err := ParseMode(recordedFile.Mode)
+				if err != nil {
+					return err
+				}
+				file = normalize(file, recordedFile.UID, recordedFile.GID, mode, recordedFile.MTime)
+			} else if file.NameInArchive == xmlName {
+				file = normalize(file, 0, 0, 0o644, reproducible.Epoch)
+			}
+		}
+		if _, ok := hardlinks[file.NameInArchive]; ok {
+			links = append(links, file)
+		} else {
+			regular = append(regular, file)
+		}
+	}
+	for _, list := range [][]archives.FileInfo{regular, links} {
+		sort.Slice(list, func(i, j int) bool { return list[i].NameInArchive < list[j].NameInArchive })
+	}
+	if err := WriteArchive(ctx, dest, append(regular, links...), DefaultArchival, DefaultCompression); err != nil {
+		return err
+	}
+	if key == nil {
+		return nil
+	}
+	if err := SignFile(key, dest); err != nil {
+		return fmt.Errorf("could not sign %s: %w", dest, err)
+	}
+	return nil
 }
@@ -0,0 +1,76 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package mpkg
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+)
+
+// RelocatableExts are the extensions of the text files in which the prefix
+// is replaced when a package is installed in another prefix.
+// Scripts, starting with #!, are also relocatable.
+var RelocatableExts = []string{
+	".pc",    // pkg-config
+	".la",    // libtool
+	".cmake", // cmake config
+}
+
+// IsRelocatable checks if the prefix can safely be replaced in the file content
+func IsRelocatable(fpath string, content []byte) bool {
+	ext := filepath.Ext(fpath)
+	for _, rext := range RelocatableExts {
+		if ext == rext {
+			return true
+		}
+	}
+	// a script, as long as it is not binary
+	return bytes.HasPrefix(content, []byte("#!")) && !bytes.Contains(content, []byte{0})
+}
+
+// RelocateFile replaces oldPrefix by newPrefix in fpath if it is relocatable.
+// It returns whether the file was rewritten and whether it contains oldPrefix.
+func RelocateFile(fpath, oldPrefix, newPrefix string) (bool, bool, error) {
+	info, err := os.Lstat(fpath)
+	if err != nil {
+		return false, false, err
+	}
+	if !info.Mode().IsRegular() {
+		return false, false, nil
+	}
+	content, err := os.ReadFile(fpath)
+	if err != nil {
+		return false, false, err
+	}
+	if !bytes.Contains(content, []byte(oldPrefix)) {
+		return false, false, nil
+	}
+	if !IsRelocatable(fpath, content) {
+		return false, true, nil
+	}
+	content = bytes.ReplaceAll(content, []byte(oldPrefix), []byte(newPrefix))
+	if err := os.WriteFile(fpath, content, info.Mode().Perm()); err != nil {
+		return false, true, err
+	}
+	return true, true, nil
+}
@@ -0,0 +1,281 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package mpkg
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// IndexFileName is the name of the index file at the root of a repository
+const IndexFileName = "index.xml"
+
+// PackageExt is the extension of the package archives created by mypkg
+const PackageExt = "." + DefaultArchival + "." + DefaultCompression
+
+// IndexEntry describes a package archive available in a repository
+type IndexEntry struct {
+	XMLName xml.Name `xml:"Package"`
+	Name    string   `xml:"Name"`
+	Version string   `xml:"Version"`
+	Release string   `xml:"Release"`
+	File    string   `xml:"File"`
+	Size    int64    `xml:"Size"`
+	MTime   int64    `xml:"MTime"`
+	Hash    string   `xml:"Hash"`
+}
+
+// Index is the list of packages available in a repository
+type Index struct {
+	XMLName  xml.Name     `xml:"Index"`
+	Packages []IndexEntry `xml:"Package"`
+}
+
+// ID returns the id of the package of the entry
+func (e *IndexEntry) ID() PackageID {
+	return PackageID{Name: e.Name, Version: e.Version, Release: e.Release}
+}
+
+// GetFullName returns the name-version-release of the entry
+func (e *IndexEntry) GetFullName() string {
+	return e.ID().String()
+}
+
+// Find returns the entry matching name, the newest version if several versions
+// of the package are available, or name-version-release. If name matches
+// different packages, an *AmbiguousError listing them is returned.
+func (i *Index) Find(name string) (*IndexEntry, error) {
+	var found []*IndexEntry
+	for idx := range i.Packages {
+		if i.Packages[idx].ID().Matches(name) {
+			found = append(found, &i.Packages[idx])
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no package %v in repository", name)
+	}
+	newest := found[0]
+	for _, entry := range found[1:] {
+		if entry.Name != newest.Name {
+			ambiguous := &AmbiguousError{Name: name}
+			for _, entry := range found {
+				ambiguous.Candidates = append(ambiguous.Candidates, entry.GetFullName())
+			}
+			return nil, ambiguous
+		}
+		if entry.ID().Compare(newest.ID()) > 0 {
+			newest = entry
+		}
+	}
+	return newest, nil
+}
+
+// CreateIndex scans dir for package archives and returns the index.
+// Hashes from previous are reused for archives whose size and mtime did not change.
+func CreateIndex(dir string, previous *Index) (*Index, error) {
+	known := map[string]IndexEntry{}
+	if previous != nil {
+		for _, entry := range previous.Packages {
+			known[entry.File] = entry
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	index := &Index{}
+	for _, dirEntry := range entries {
+		if dirEntry.IsDir() || !strings.HasSuffix(dirEntry.Name(), PackageExt) {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			return nil, err
+		}
+		id, err := ParseArchiveName(dirEntry.Name())
+		if err != nil {
+			continue
+		}
+		entry := IndexEntry{
+			Name:    id.Name,
+			Version: id.Version,
+			Release: id.Release,
+			File:    dirEntry.Name(),
+			Size:    info.Size(),
+			MTime:   info.ModTime().Unix(),
+		}
+		if old, ok := known[entry.File]; ok && old.Size == entry.Size && old.MTime == entry.MTime {
+			entry.Hash = old.Hash
+		} else {
+			hash, err := GetHashString(filepath.Join(dir, entry.File))
+			if err != nil {
+				return nil, fmt.Errorf("could not get the hash of %s: %w", entry.File, err)
+			}
+			entry.Hash = hash
+		}
+		index.Packages = append(index.Packages, entry)
+	}
+	return index, nil
+}
+
+// MarshalIndex returns the xml representation of the index
+func MarshalIndex(index *Index) ([]byte, error) {
+	output, err := xml.MarshalIndent(index, "", "    ")
+	if err != nil {
+		return nil, fmt.Errorf("could not marchal xml: %v", err)
+	}
+	return output, nil
+}
+
+// WriteIndex creates the index of dir and writes it in dir/index.xml
+func WriteIndex(dir string) error {
+	index, err := CreateIndex(dir, nil)
+	if err != nil {
+		return err
+	}
+	output, err := MarshalIndex(index)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, IndexFileName), output, defaultFileMode)
+}
+
+// Repository is a remote package repository served by `mypkg serve`
+type Repository struct {
+	URL   string
+	Token string
+	// Trust verifies the signature of the index when not nil
+	Trust *TrustStore
+}
+
+// NewRepository returns a repository client for the given url
+func NewRepository(url, token string, trust *TrustStore) *Repository {
+	return &Repository{
+		URL:   strings.TrimSuffix(url, "/"),
+		Token: token,
+		Trust: trust,
+	}
+}
+
+var errNotFound = errors.New("not found")
+
+// get requests a file of the repository
+func (r *Repository) get(name string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, r.URL+"/"+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("could not get %s/%s: %w", r.URL, name, errNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("could not get %s/%s: %s", r.URL, name, resp.Status)
+	}
+	return resp, nil
+}
+
+// fetch returns the content of a file of the repository
+func (r *Repository) fetch(name string) ([]byte, error) {
+	resp, err := r.get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// FetchIndex downloads and decodes the index of the repository.
+// The signature of the index is verified if the repository has a trust store.
+func (r *Repository) FetchIndex() (*Index, error) {
+	content, err := r.fetch(IndexFileName)
+	if err != nil {
+		return nil, err
+	}
+	if r.Trust != nil {
+		signature, err := r.fetch(IndexFileName + SignatureExt)
+		if errors.Is(err, errNotFound) {
+			return nil, fmt.Errorf("index of %s: %w", r.URL, ErrNotSigned)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := r.Trust.Verify(content, signature); err != nil {
+			return nil, fmt.Errorf("index of %s: %w", r.URL, err)
+		}
+	}
+	var index Index
+	if err := xml.Unmarshal(content, &index); err != nil {
+		return nil, fmt.Errorf("could not unmarchal index: %w", err)
+	}
+	return &index, nil
+}
+
+// Download downloads the archive of entry in dest and verifies its hash.
+// The signature of the archive, if any, is downloaded in dest.sig
+func (r *Repository) Download(entry *IndexEntry, dest string) error {
+	resp, err := r.get(entry.File)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return err
+	}
+	hash, err := GetHashString(dest)
+	if err != nil {
+		return err
+	}
+	if hash != entry.Hash {
+		return fmt.Errorf("wrong sha256 of file %s; want %v, got %v", entry.File, entry.Hash, hash)
+	}
+	signature, err := r.fetch(entry.File + SignatureExt)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dest+SignatureExt, signature, defaultFileMode)
+}
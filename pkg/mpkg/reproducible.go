@@ -0,0 +1,231 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package mpkg
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mholt/archives"
+)
+
+// SourceDateEpochEnv is the variable giving the date of the files of reproducible builds
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// Reproducible normalizes the archived files, so that two builds of the same
+// recipe give the same archive
+type Reproducible struct {
+	// Epoch is the latest modification time of the archived files, in seconds since the epoch
+	Epoch int64
+}
+
+// NewReproducible returns the options of a reproducible build, dated with
+// SOURCE_DATE_EPOCH, or the epoch if it is not set
+func NewReproducible() (*Reproducible, error) {
+	value := os.Getenv(SourceDateEpochEnv)
+	if value == "" {
+		return &Reproducible{}, nil
+	}
+	epoch, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || epoch < 0 {
+		return nil, fmt.Errorf("invalid %s %q", SourceDateEpochEnv, value)
+	}
+	return &Reproducible{Epoch: epoch}, nil
+}
+
+// Normalize clamps the mtimes of the files of container to Epoch, and normalizes
+// their modes: 0755 for directories and executables, 0644 for the other files.
+// setuid, setgid and sticky bits are kept.
+func (r *Reproducible) Normalize(container *Set) error {
+	for i := range container.Files {
+		file := &container.Files[i]
+		if file.MTime > r.Epoch {
+			file.MTime = r.Epoch
+		}
+		if file.IsSymlink() {
+			continue
+		}
+		mode, err := ParseMode(file.Mode)
+		if err != nil {
+			return err
+		}
+		file.Mode = FormatMode(normalizeMode(mode, mode&0o100 != 0))
+	}
+	for i := range container.Dirs {
+		dir := &container.Dirs[i]
+		mode, err := ParseMode(dir.Mode)
+		if err != nil {
+			return err
+		}
+		dir.Mode = FormatMode(normalizeMode(mode, true))
+	}
+	return nil
+}
+
+func normalizeMode(mode os.FileMode, executable bool) os.FileMode {
+	special := mode & (os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if executable {
+		return special | 0o755
+	}
+	return special | 0o644
+}
+
+// normalizedInfo archives a file with the attributes recorded in files.xml
+// instead of the ones on disk
+type normalizedInfo struct {
+	fs.FileInfo
+	mode   fs.FileMode
+	mtime  time.Time
+	header *tar.Header
+}
+
+func (n normalizedInfo) Mode() fs.FileMode  { return n.mode }
+func (n normalizedInfo) ModTime() time.Time { return n.mtime }
+func (n normalizedInfo) Sys() any           { return n.header }
+
+// normalize returns file archived with the given owner, mode and mtime, without
+// user and group names. The mode replaces the permissions of the file on disk.
+func normalize(file archives.FileInfo, uid, gid int, mode fs.FileMode, mtime int64) archives.FileInfo {
+	header := &tar.Header{Uid: uid, Gid: gid}
+	// hard links made by AsHardlink
+	if linkHeader, ok := file.Sys().(*tar.Header); ok {
+		header.Typeflag = linkHeader.Typeflag
+		header.Linkname = linkHeader.Linkname
+	}
+	file.FileInfo = normalizedInfo{
+		FileInfo: file.FileInfo,
+		mode:     file.Mode().Type() | mode,
+		mtime:    time.Unix(mtime, 0),
+		header:   header,
+	}
+	return file
+}
+
+// CompareArchives compares the entries of the archives a and b, and returns
+// the differences, one per entry, sorted by name
+func CompareArchives(a, b string) ([]string, error) {
+	entriesA, err := readArchiveEntries(a)
+	if err != nil {
+		return nil, err
+	}
+	entriesB, err := readArchiveEntries(b)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []string
+	for name, entryA := range entriesA {
+		entryB, ok := entriesB[name]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%s: only in the first build", name))
+		case entryA != entryB:
+			diffs = append(diffs, fmt.Sprintf("%s: %s differs", name, entryA.diff(entryB)))
+		}
+	}
+	for name := range entriesB {
+		if _, ok := entriesA[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: only in the second build", name))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs, nil
+}
+
+// archiveEntry is what is compared of an entry of an archive
+type archiveEntry struct {
+	mode       fs.FileMode
+	uid, gid   int
+	uname      string
+	gname      string
+	mtime      int64
+	linkTarget string
+	hash       string
+}
+
+func (e archiveEntry) diff(other archiveEntry) string {
+	switch {
+	case e.hash != other.hash:
+		return "content"
+	case e.mode != other.mode:
+		return fmt.Sprintf("mode (%v, %v)", e.mode, other.mode)
+	case e.uid != other.uid || e.gid != other.gid || e.uname != other.uname || e.gname != other.gname:
+		return fmt.Sprintf("owner (%d:%d %s:%s, %d:%d %s:%s)", e.uid, e.gid, e.uname, e.gname, other.uid, other.gid, other.uname, other.gname)
+	case e.mtime != other.mtime:
+		return fmt.Sprintf("mtime (%v, %v)", time.Unix(e.mtime, 0).UTC(), time.Unix(other.mtime, 0).UTC())
+	default:
+		return fmt.Sprintf("link target (%v, %v)", e.linkTarget, other.linkTarget)
+	}
+}
+
+// readArchiveEntries reads the entries of the archive fpath by name
+func readArchiveEntries(fpath string) (map[string]archiveEntry, error) {
+	archivef, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer archivef.Close()
+	ctx := context.Background()
+	format, input, err := archives.Identify(ctx, fpath, archivef)
+	if err != nil {
+		return nil, err
+	}
+	extractor, ok := format.(archives.Extractor)
+	if !ok {
+		return nil, errors.New("unsupported archive format for extraction")
+	}
+	entries := map[string]archiveEntry{}
+	err = extractor.Extract(ctx, input, func(ctx context.Context, f archives.FileInfo) error {
+		entry := archiveEntry{mode: f.Mode(), mtime: f.ModTime().Unix(), linkTarget: f.LinkTarget}
+		if header, ok := f.Header.(*tar.Header); ok {
+			entry.uid, entry.gid = header.Uid, header.Gid
+			entry.uname, entry.gname = header.Uname, header.Gname
+		}
+		if f.Mode().IsRegular() {
+			reader, err := f.Open()
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+			hash := sha256.New()
+			if _, err := io.Copy(hash, reader); err != nil {
+				return err
+			}
+			entry.hash = hex.EncodeToString(hash.Sum(nil))
+		}
+		entries[f.NameInArchive] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", fpath, err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,57 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package mpkg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SandboxReadOnlyDirs are the system directories exposed read-only in a sandbox
+var SandboxReadOnlyDirs = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/etc", "/opt"}
+
+// Sandbox restricts the commands run by a Shell to some paths, without network.
+// Everything else is hidden, $HOME included.
+type Sandbox struct {
+	// ReadOnly are the paths exposed read-only
+	ReadOnly []string `json:"readOnly"`
+	// Writable are the paths exposed read-write
+	Writable []string `json:"writable"`
+}
+
+// NewSandbox returns a sandbox exposing the writable paths, the system
+// directories and the readOnly paths
+func NewSandbox(writable []string, readOnly ...string) *Sandbox {
+	return &Sandbox{
+		ReadOnly: append(append([]string{}, SandboxReadOnlyDirs...), readOnly...),
+		Writable: writable,
+	}
+}
+
+// SandboxViolationError lists the writes attempted outside the writable paths of a sandbox
+type SandboxViolationError struct {
+	Paths []string
+}
+
+func (e *SandboxViolationError) Error() string {
+	return fmt.Sprintf("attempted to write outside the sandbox: %s", strings.Join(e.Paths, ", "))
+}
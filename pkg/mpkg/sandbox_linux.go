@@ -0,0 +1,368 @@
+//go:build linux
+
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package mpkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sandboxArg0 is the name the sandbox helper is run with
+const sandboxArg0 = "mypkg-sandbox"
+
+// Kinds of sandbox mounts
+const (
+	mountReadOnly = "ro"
+	mountWritable = "rw"
+	mountTmpfs    = "tmpfs"
+)
+
+// sandboxSpec is what the sandbox helper receives from Run
+type sandboxSpec struct {
+	Sandbox
+	// Root is the directory where the helper mounts its tmpfs
+	Root string `json:"root"`
+	// Dir is the working directory of the command
+	Dir string `json:"dir"`
+}
+
+// sandboxMount is a path exposed in the sandbox
+type sandboxMount struct {
+	Path string
+	Kind string
+	// Upper is the overlay upper directory of read-only paths, where their writes end up
+	Upper string
+}
+
+// SandboxInit runs the sandbox helper when the current process is one, and exits.
+// It must be called first in main, Sandbox.Run runs the executable again as the helper.
+func SandboxInit() {
+	if len(os.Args) < 3 || os.Args[0] != sandboxArg0 {
+		return
+	}
+	code, err := runSandbox(os.Args[1], os.Args[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", sandboxArg0, err)
+	}
+	os.Exit(code)
+}
+
+// Run runs cmd in new user, mount and network namespaces where only the paths of
+// the sandbox are visible. Writes to the read-only paths are discarded and
+// reported with a SandboxViolationError, as well as files created in the hidden paths.
+func (s *Sandbox) Run(cmd *exec.Cmd) error {
+	root, err := os.MkdirTemp("", "mypkg-sandbox-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+	spec := sandboxSpec{Sandbox: *s, Root: root, Dir: cmd.Dir}
+	if spec.Dir == "" {
+		if spec.Dir, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	cmd.Args = append([]string{sandboxArg0, string(data), cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/proc/self/exe"
+	// The user is root in the namespace to be able to mount, the files it creates
+	// are still owned by the user outside
+	// The attributes of the command, like its process group, are kept
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	// The helper reports the violations in a pipe
+	report, reportWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer report.Close()
+	cmd.ExtraFiles = []*os.File{reportWriter}
+	if err := cmd.Start(); err != nil {
+		reportWriter.Close()
+		return fmt.Errorf("could not start the sandbox, user namespaces may be disabled: %w", err)
+	}
+	reportWriter.Close()
+	var violations []string
+	scanner := bufio.NewScanner(report)
+	for scanner.Scan() {
+		violations = append(violations, scanner.Text())
+	}
+	err = cmd.Wait()
+	if len(violations) > 0 {
+		return &SandboxViolationError{Paths: violations}
+	}
+	return err
+}
+
+// runSandbox sets up the sandbox described by the json data and runs args in it.
+// It returns the exit code of the command.
+func runSandbox(data string, args []string) (int, error) {
+	// The report pipe must not leak to the command
+	report := os.NewFile(3, "report")
+	syscall.CloseOnExec(3)
+	defer report.Close()
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(data), &spec); err != nil {
+		return 1, err
+	}
+	mounts, err := spec.mount()
+	if err != nil {
+		return 1, err
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Dir = spec.Dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: filepath.Join(spec.Root, "root")}
+	code := 0
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return 1, err
+		}
+		code = exitErr.ExitCode()
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			code = 128 + int(status.Signal())
+		}
+	}
+	violations, err := spec.violations(mounts)
+	if err != nil {
+		return 1, err
+	}
+	for _, violation := range violations {
+		fmt.Fprintln(report, violation)
+	}
+	return code, nil
+}
+
+// mount builds the root of the sandbox in a tmpfs mounted on Root, and returns its mounts
+func (spec *sandboxSpec) mount() ([]sandboxMount, error) {
+	// Nothing done here must propagate to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return nil, fmt.Errorf("could not make the mounts private: %w", err)
+	}
+	if err := syscall.Mount("tmpfs", spec.Root, "tmpfs", 0, "mode=0755"); err != nil {
+		return nil, fmt.Errorf("could not mount the sandbox root: %w", err)
+	}
+	root := filepath.Join(spec.Root, "root")
+	for _, dir := range []string{"root", "upper", "work"} {
+		if err := os.Mkdir(filepath.Join(spec.Root, dir), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	paths := map[string]string{"/dev": mountWritable, "/proc": mountWritable, "/tmp": mountTmpfs}
+	add := func(path, kind string) {
+		if paths[path] != mountWritable {
+			paths[path] = kind
+		}
+	}
+	for _, path := range spec.ReadOnly {
+		add(filepath.Clean(path), mountReadOnly)
+	}
+	for _, path := range spec.Writable {
+		add(filepath.Clean(path), mountWritable)
+	}
+	// Symbolic links, like /bin on merged /usr systems, are reproduced and their target exposed
+	for path, kind := range paths {
+		info, err := os.Lstat(path)
+		if err != nil {
+			delete(paths, path)
+			continue
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			continue
+		}
+		delete(paths, path)
+		linkTarget, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, path)), 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.Symlink(linkTarget, filepath.Join(root, path)); err != nil {
+			return nil, err
+		}
+		if target, err := filepath.EvalSymlinks(path); err == nil {
+			add(target, kind)
+		}
+	}
+	var mounts []sandboxMount
+	for path, kind := range paths {
+		mounts = append(mounts, sandboxMount{Path: path, Kind: kind})
+	}
+	// Parents are mounted before their children
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Path < mounts[j].Path })
+	for i := range mounts {
+		m := &mounts[i]
+		target := filepath.Join(root, m.Path)
+		if err := os.MkdirAll(target, 0o755); err != nil {
+			return nil, err
+		}
+		var err error
+		switch m.Kind {
+		case mountTmpfs:
+			err = syscall.Mount("tmpfs", target, "tmpfs", 0, "mode=1777")
+		case mountWritable:
+			err = syscall.Mount(m.Path, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+		case mountReadOnly:
+			err = m.mountReadOnly(spec.Root, i, target)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not expose %v: %w", m.Path, err)
+		}
+	}
+	return mounts, nil
+}
+
+// mountReadOnly mounts an overlay of m.Path on target so its writes can be reported,
+// or a read-only bind mount if overlays are not supported
+func (m *sandboxMount) mountReadOnly(sandboxRoot string, i int, target string) error {
+	upper := filepath.Join(sandboxRoot, "upper", strconv.Itoa(i))
+	work := filepath.Join(sandboxRoot, "work", strconv.Itoa(i))
+	for _, dir := range []string{upper, work} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", m.Path, upper, work)
+	if err := syscall.Mount("overlay", target, "overlay", 0, options); err == nil {
+		m.Upper = upper
+		return nil
+	}
+	if err := syscall.Mount(m.Path, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	// The flags locked by the host must be kept when remounting
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(m.Path, &stat); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	for statFlag, mountFlag := range map[int64]uintptr{
+		0x2:    syscall.MS_NOSUID,
+		0x4:    syscall.MS_NODEV,
+		0x8:    syscall.MS_NOEXEC,
+		0x400:  syscall.MS_NOATIME,
+		0x800:  syscall.MS_NODIRATIME,
+		0x1000: syscall.MS_RELATIME,
+	} {
+		if stat.Flags&statFlag != 0 {
+			flags |= mountFlag
+		}
+	}
+	return syscall.Mount("", target, "", flags, "")
+}
+
+// violations returns the paths written in the read-only paths, and
+// the ones created outside of the exposed paths
+func (spec *sandboxSpec) violations(mounts []sandboxMount) ([]string, error) {
+	var violations []string
+	// The directories leading to the mount points were created by mount
+	created := map[string]bool{}
+	for _, m := range mounts {
+		for dir := m.Path; dir != "/"; dir = filepath.Dir(dir) {
+			created[dir] = true
+		}
+	}
+	mounted := func(path string) bool {
+		for _, m := range mounts {
+			if m.Path == path {
+				return true
+			}
+		}
+		return false
+	}
+	root := filepath.Join(spec.Root, "root")
+	err := filepath.WalkDir(root, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil || fpath == root {
+			return err
+		}
+		path := strings.TrimPrefix(fpath, root)
+		if mounted(path) {
+			return filepath.SkipDir
+		}
+		if d.Type()&fs.ModeSymlink != 0 || created[path] {
+			return nil
+		}
+		violations = append(violations, path)
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range mounts {
+		if m.Upper == "" {
+			continue
+		}
+		err := filepath.WalkDir(m.Upper, func(fpath string, d fs.DirEntry, err error) error {
+			if err != nil || fpath == m.Upper {
+				return err
+			}
+			path := filepath.Join(m.Path, strings.TrimPrefix(fpath, m.Upper))
+			// Directories are copied up along with the files written in them
+			if d.IsDir() {
+				if info, err := os.Stat(path); err == nil && info.IsDir() {
+					return nil
+				}
+			}
+			if created[path] {
+				return nil
+			}
+			violations = append(violations, path)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(violations)
+	return violations, nil
+}
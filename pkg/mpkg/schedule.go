@@ -0,0 +1,206 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package mpkg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Statuses of the packages built by Schedule
+const (
+	BuildOK      = "built"
+	BuildFailed  = "failed"
+	BuildSkipped = "skipped"
+)
+
+// buildRunning is the status of the packages being built
+const buildRunning = "running"
+
+// BuildResult is the outcome of the build of a package by Schedule
+type BuildResult struct {
+	Desc     *PackageDesc
+	Status   string
+	Err      error
+	Duration time.Duration
+}
+
+// SortByDependencies returns descs sorted so that each package comes after the
+// packages it depends on, in the given order otherwise. Dependencies that are
+// not in descs are ignored.
+func SortByDependencies(descs []*PackageDesc) ([]*PackageDesc, error) {
+	index := map[string]int{}
+	for i, desc := range descs {
+		if _, ok := index[desc.Name]; ok {
+			return nil, fmt.Errorf("%s is given twice", desc.Name)
+		}
+		index[desc.Name] = i
+	}
+	var sorted []*PackageDesc
+	added := make([]bool, len(descs))
+	for len(sorted) < len(descs) {
+		progress := false
+		for i, desc := range descs {
+			if added[i] {
+				continue
+			}
+			ready := true
+			for _, dep := range desc.Depends {
+				if j, ok := index[dep]; ok && !added[j] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				sorted = append(sorted, desc)
+				added[i] = true
+				progress = true
+			}
+		}
+		if !progress {
+			return nil, fmt.Errorf("circular dependencies between %s", strings.Join(cycle(descs, added), ", "))
+		}
+	}
+	return sorted, nil
+}
+
+// cycle returns the names of the packages not added that are in a cycle, leaving
+// out the ones only depending on a cycle
+func cycle(descs []*PackageDesc, added []bool) []string {
+	remaining := map[string]*PackageDesc{}
+	for i, desc := range descs {
+		if !added[i] {
+			remaining[desc.Name] = desc
+		}
+	}
+	for {
+		needed := map[string]bool{}
+		for _, desc := range remaining {
+			for _, dep := range desc.Depends {
+				needed[dep] = true
+			}
+		}
+		removed := false
+		for name := range remaining {
+			if !needed[name] {
+				delete(remaining, name)
+				removed = true
+			}
+		}
+		if !removed {
+			break
+		}
+	}
+	var names []string
+	for _, desc := range descs {
+		if _, ok := remaining[desc.Name]; ok {
+			names = append(names, desc.Name)
+		}
+	}
+	return names
+}
+
+// Schedule builds descs with build, up to jobs at a time, each package once the
+// packages it depends on are built. The packages depending on a package that
+// failed are skipped, and so are the ones not started yet unless keepGoing.
+// The results are in the order of SortByDependencies.
+func Schedule(descs []*PackageDesc, jobs int, keepGoing bool, build func(desc *PackageDesc) error) ([]BuildResult, error) {
+	sorted, err := SortByDependencies(descs)
+	if err != nil {
+		return nil, err
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+	index := map[string]int{}
+	for i, desc := range sorted {
+		index[desc.Name] = i
+	}
+	results := make([]BuildResult, len(sorted))
+	for i, desc := range sorted {
+		results[i].Desc = desc
+	}
+	done := make(chan int)
+	running := 0
+	stopped := false
+	for {
+		for i, desc := range sorted {
+			if stopped || running >= jobs {
+				break
+			}
+			if results[i].Status != "" {
+				continue
+			}
+			ready := true
+			for _, dep := range desc.Depends {
+				j, ok := index[dep]
+				if !ok {
+					continue
+				}
+				switch results[j].Status {
+				case BuildOK:
+				case BuildFailed, BuildSkipped:
+					results[i].Status = BuildSkipped
+					results[i].Err = fmt.Errorf("%s was not built", dep)
+					ready = false
+				default:
+					ready = false
+				}
+				if !ready {
+					break
+				}
+			}
+			if !ready {
+				continue
+			}
+			results[i].Status = buildRunning
+			running++
+			go func(i int) {
+				start := time.Now()
+				err := build(sorted[i])
+				results[i].Duration = time.Since(start)
+				results[i].Err = err
+				done <- i
+			}(i)
+		}
+		if running == 0 {
+			break
+		}
+		i := <-done
+		running--
+		if results[i].Err != nil {
+			results[i].Status = BuildFailed
+			stopped = !keepGoing
+		} else {
+			results[i].Status = BuildOK
+		}
+	}
+	for i := range results {
+		if results[i].Status == "" {
+			results[i].Status = BuildSkipped
+			results[i].Err = errors.New("not started after a failure")
+		}
+	}
+	return results, nil
+}
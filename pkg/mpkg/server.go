@@ -0,0 +1,179 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package mpkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RepoServer serves the package archives of a directory and its index over http
+type RepoServer struct {
+	Dir   string
+	Token string
+	// Key signs the index when not nil
+	Key ed25519.PrivateKey
+
+	mu    sync.Mutex
+	index *Index
+}
+
+// NewRepoServer returns a server for the repository in dir.
+// If token is not empty, clients must provide it as a bearer token.
+// If key is not nil, the index is signed with it.
+func NewRepoServer(dir, token string, key ed25519.PrivateKey) *RepoServer {
+	return &RepoServer{
+		Dir:   dir,
+		Token: token,
+		Key:   key,
+	}
+}
+
+// Index returns the index of the repository, refreshed from the directory content
+func (s *RepoServer) Index() (*Index, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	index, err := CreateIndex(s.Dir, s.index)
+	if err != nil {
+		return nil, err
+	}
+	s.index = index
+	return index, nil
+}
+
+func (s *RepoServer) authorized(r *http.Request) bool {
+	if s.Token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+func (s *RepoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logrus.Infof("%s %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mypkg"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	if name == "" || name == IndexFileName {
+		s.serveIndex(w, r, false)
+		return
+	}
+	if name == IndexFileName+SignatureExt {
+		s.serveIndex(w, r, true)
+		return
+	}
+	s.servePackage(w, r, name)
+}
+
+func (s *RepoServer) serveIndex(w http.ResponseWriter, r *http.Request, signature bool) {
+	index, err := s.Index()
+	if err != nil {
+		logrus.Errorf("could not create index: %v", err)
+		http.Error(w, "could not create index", http.StatusInternalServerError)
+		return
+	}
+	output, err := MarshalIndex(index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := IndexFileName
+	w.Header().Set("Content-Type", "application/xml")
+	if signature {
+		if s.Key == nil {
+			http.NotFound(w, r)
+			return
+		}
+		// ed25519 signatures are deterministic, the signature matches
+		// the index as long as the directory is unchanged
+		output = Sign(s.Key, output)
+		name += SignatureExt
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	sum := sha256.Sum256(output)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(output))
+}
+
+func (s *RepoServer) servePackage(w http.ResponseWriter, r *http.Request, name string) {
+	index, err := s.Index()
+	if err != nil {
+		logrus.Errorf("could not create index: %v", err)
+		http.Error(w, "could not create index", http.StatusInternalServerError)
+		return
+	}
+	archive, signature := strings.CutSuffix(name, SignatureExt)
+	var entry *IndexEntry
+	for idx := range index.Packages {
+		if index.Packages[idx].File == archive {
+			entry = &index.Packages[idx]
+			break
+		}
+	}
+	if entry == nil {
+		http.NotFound(w, r)
+		return
+	}
+	fpath, err := SecurePath(s.Dir, name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if !signature {
+		w.Header().Set("ETag", `"`+entry.Hash+`"`)
+	}
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
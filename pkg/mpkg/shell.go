@@ -23,33 +23,281 @@ package mpkg
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// DefaultInterpreter is the shell running the commands if none is set
+var DefaultInterpreter = []string{"/bin/sh"}
+
+// Shell runs the commands of a step, each in its own shell. The lines added
+// with AddArgs run before each command. The exported variables, the variables
+// a command sets and its working directory carry over to the next command.
+// A command starting with #! is a script, run with the interpreter it names,
+// the variables are exported to it.
 type Shell struct {
 	Commands []string
+	// Env is the environment the commands start with, the one of the process if nil
+	Env []string
+	// Interpreter is the shell with its options, DefaultInterpreter if empty.
+	// It is given -c and the commands.
+	Interpreter []string
+	// Sandbox runs the commands in a sandbox when not nil
+	Sandbox *Sandbox
+	// Stdout and Stderr receive the output of the commands, os.Stdout and os.Stderr if nil
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// CommandResult is the outcome of a command run by Shell
+type CommandResult struct {
+	Command  string
+	ExitCode int
+	Duration time.Duration
+	// Output is the standard output and error of the command
+	Output string
+}
+
+// Summary returns the command, only its first line for a script
+func (r CommandResult) Summary() string {
+	if first, _, found := strings.Cut(r.Command, "\n"); found {
+		return first + " ..."
+	}
+	return r.Command
+}
+
+// CommandError is the failure of a command of a step
+type CommandError struct {
+	// Step is the name of the step, if known
+	Step string
+	// Line is the number of the command in the step, from 1
+	Line   int
+	Result CommandResult
+	Err    error
+}
+
+func (e *CommandError) Error() string {
+	where := fmt.Sprintf("line %d", e.Line)
+	if e.Step != "" {
+		where = fmt.Sprintf("%s step, line %d", e.Step, e.Line)
+	}
+	return fmt.Sprintf("%s: %q failed: %v", where, e.Result.Summary(), e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
 }
 
 func NewShell() *Shell {
-	cmd := &Shell{}
-	cmd.Commands = append(cmd.Commands, "set -xe; ")
-	return cmd
+	return &Shell{}
 }
 
 func (c *Shell) AddArgs(args string) {
 	c.Commands = append(c.Commands, args+"; ")
 }
 
-func (c *Shell) Exec(dir string, args []string) error {
-	var stdoutBuf, stderrBuf bytes.Buffer
-	_args := append(c.Commands, args...)
-	_exec := strings.Join(_args, " ")
-	cmd := exec.Command("/bin/sh", "-c", _exec)
-	cmd.Stdout = io.MultiWriter(os.Stdout, &stdoutBuf)
-	cmd.Stderr = io.MultiWriter(os.Stderr, &stderrBuf)
+// Exec runs the commands in dir, one after the other, and returns their
+// results. It stops at the first command that fails and returns a *CommandError.
+// When ctx is done, the running command and its children are killed.
+func (c *Shell) Exec(ctx context.Context, dir string, commands []string) ([]CommandResult, error) {
+	// The state of the shell is saved between the commands in stateDir
+	stateDir, err := os.MkdirTemp("", "mypkg-shell-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stateDir)
+	sandbox := c.Sandbox
+	if sandbox != nil {
+		withState := *sandbox
+		withState.Writable = append(append([]string{}, sandbox.Writable...), stateDir)
+		sandbox = &withState
+	}
+	envFile := shellQuote(filepath.Join(stateDir, "env"))
+	cwdFile := shellQuote(filepath.Join(stateDir, "cwd"))
+	var results []CommandResult
+	for i, command := range commands {
+		line, export := command, ""
+		if strings.HasPrefix(command, "#!") {
+			scriptFile, err := writeScript(stateDir, i+1, command)
+			if err != nil {
+				return results, &CommandError{Line: i + 1, Result: CommandResult{Command: command, ExitCode: -1}, Err: err}
+			}
+			line, export = shellQuote(scriptFile), "set -a; "
+		}
+		script := "set -e; " + export + strings.Join(c.Commands, "") +
+			"if [ -f " + envFile + " ]; then . " + envFile + "; cd \"$(cat " + cwdFile + ")\"; fi; " +
+			"trap '{ set +x; } 2>/dev/null; export -p > " + envFile + "; pwd > " + cwdFile + "' EXIT; " +
+			"set -ax\n" + line + "\n"
+		result, err := c.run(ctx, sandbox, dir, script)
+		result.Command = command
+		results = append(results, result)
+		if err != nil {
+			return results, &CommandError{Line: i + 1, Result: result, Err: err}
+		}
+	}
+	return results, nil
+}
+
+// run runs script in dir, with sandbox if not nil
+func (c *Shell) run(ctx context.Context, sandbox *Sandbox, dir, script string) (CommandResult, error) {
+	if err := ctx.Err(); err != nil {
+		return CommandResult{ExitCode: -1}, err
+	}
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if c.Stdout != nil {
+		stdout = c.Stdout
+	}
+	if c.Stderr != nil {
+		stderr = c.Stderr
+	}
+	output := &lockedBuffer{}
+	interpreter := c.Interpreter
+	if len(interpreter) == 0 {
+		interpreter = DefaultInterpreter
+	}
+	args := append(append([]string{}, interpreter[1:]...), "-c", script)
+	cmd := exec.CommandContext(ctx, interpreter[0], args...)
+	// The command runs in its own process group, killed as a whole on cancel
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		if cmd.Process == nil {
+			return nil
+		}
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Do not wait for the output of the processes that escaped the group
+	cmd.WaitDelay = 5 * time.Second
+	cmd.Stdout = io.MultiWriter(stdout, output)
+	cmd.Stderr = io.MultiWriter(stderr, output)
+	cmd.Dir = dir
+	cmd.Env = c.Env
+	start := time.Now()
+	var err error
+	if sandbox != nil {
+		err = sandbox.Run(cmd)
+	} else {
+		err = cmd.Run()
+	}
+	result := CommandResult{Duration: time.Since(start), Output: output.String()}
+	if err != nil && ctx.Err() != nil {
+		// Cancel killed the group while the shell ran, the processes it left
+		// in the background go too. The command may not have started.
+		if cmd.Process != nil {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+		err = fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitCode()
+	default:
+		result.ExitCode = -1
+	}
+	return result, err
+}
+
+// Environ returns the environment of the commands run in dir, sorted
+func (c *Shell) Environ(ctx context.Context, dir string) ([]string, error) {
+	interpreter := c.Interpreter
+	if len(interpreter) == 0 {
+		interpreter = DefaultInterpreter
+	}
+	args := append(append([]string{}, interpreter[1:]...), "-c", "set -e; "+strings.Join(c.Commands, "")+"\nexec env -0")
+	cmd := exec.CommandContext(ctx, interpreter[0], args...)
 	cmd.Dir = dir
-	return cmd.Run()
+	cmd.Env = c.Env
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	env := strings.Split(strings.TrimSuffix(string(output), "\x00"), "\x00")
+	sort.Strings(env)
+	return env, nil
+}
+
+// DefaultEnvAllowlist are the variables of the environment kept by CleanEnv by default
+var DefaultEnvAllowlist = []string{"PATH", "HOME", "TERM"}
+
+// CleanEnv returns the variables of the environment in allowlist, and vars
+func CleanEnv(allowlist []string, vars ...string) []string {
+	var env []string
+	for _, name := range allowlist {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return append(env, vars...)
+}
+
+// CheckInterpreter checks that the shell interpreter, DefaultInterpreter if
+// empty, is installed
+func CheckInterpreter(interpreter []string) error {
+	if len(interpreter) == 0 {
+		interpreter = DefaultInterpreter
+	}
+	if _, err := exec.LookPath(interpreter[0]); err != nil {
+		return fmt.Errorf("shell %v is not installed: %w", interpreter[0], err)
+	}
+	return nil
+}
+
+// writeScript writes the script of the line-th command in dir, checks that its
+// interpreter is installed and returns its path
+func writeScript(dir string, line int, script string) (string, error) {
+	shebang, _, _ := strings.Cut(strings.TrimPrefix(script, "#!"), "\n")
+	fields := strings.Fields(shebang)
+	if len(fields) == 0 {
+		return "", errors.New("no interpreter after #!")
+	}
+	interpreter := fields[0]
+	// #!/usr/bin/env [-S] python3
+	if filepath.Base(interpreter) == "env" {
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") {
+				interpreter = field
+				break
+			}
+		}
+	}
+	if _, err := exec.LookPath(interpreter); err != nil {
+		return "", fmt.Errorf("interpreter %v is not installed: %w", interpreter, err)
+	}
+	fpath := filepath.Join(dir, fmt.Sprintf("script-%d", line))
+	return fpath, os.WriteFile(fpath, []byte(script), 0o755)
+}
+
+// lockedBuffer is a buffer written by the copies of stdout and stderr
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(data []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(data)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// shellQuote quotes s for /bin/sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
@@ -0,0 +1,294 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package mpkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SignatureExt is appended to the name of a file to get its detached signature
+const SignatureExt = ".sig"
+
+const (
+	signaturePEMType = "MYPKG SIGNATURE"
+	privateKeyPEM    = "PRIVATE KEY"
+	publicKeyPEM     = "PUBLIC KEY"
+	keyIDHeader      = "Key-Id"
+	revokedDir       = "revoked"
+	publicKeyExt     = ".pub"
+)
+
+var (
+	// ErrNotSigned is returned when a file has no signature
+	ErrNotSigned = errors.New("not signed")
+	// ErrUntrusted is returned when a file is signed by a key not in the trust store
+	ErrUntrusted = errors.New("signed by an untrusted key")
+	// ErrRevoked is returned when a file is signed by a revoked key
+	ErrRevoked = errors.New("signed by a revoked key")
+)
+
+// KeyID returns the identifier of a public key; the first 16 hex digits of its sha256
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// GenerateKey creates a new ed25519 key pair, writes the private key in
+// keyPath and the public key in keyPath.pub
+func GenerateKey(keyPath string) (ed25519.PublicKey, error) {
+	if IsExit(keyPath) {
+		return nil, fmt.Errorf("%s already exists", keyPath)
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err := CreateDirIfNotExist(filepath.Dir(keyPath)); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: privateKeyPEM, Bytes: der}), defaultFileMode); err != nil {
+		return nil, err
+	}
+	if err := WritePublicKey(keyPath+publicKeyExt, pub); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// WritePublicKey writes pub in fpath as a PEM block
+func WritePublicKey(fpath string, pub ed25519.PublicKey) error {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fpath, pem.EncodeToMemory(&pem.Block{Type: publicKeyPEM, Bytes: der}), 0o644)
+}
+
+// ReadPrivateKey reads an ed25519 private key written by GenerateKey
+func ReadPrivateKey(fpath string) (ed25519.PrivateKey, error) {
+	content, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != privateKeyPEM {
+		return nil, fmt.Errorf("%s is not a private key", fpath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", fpath)
+	}
+	return priv, nil
+}
+
+// ReadPublicKey reads an ed25519 public key written by WritePublicKey
+func ReadPublicKey(fpath string) (ed25519.PublicKey, error) {
+	content, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != publicKeyPEM {
+		return nil, fmt.Errorf("%s is not a public key", fpath)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", fpath)
+	}
+	return pub, nil
+}
+
+// Sign returns the detached signature of content. The sha256 of content is signed.
+func Sign(key ed25519.PrivateKey, content []byte) []byte {
+	sum := sha256.Sum256(content)
+	return signDigest(key, sum[:])
+}
+
+func signDigest(key ed25519.PrivateKey, digest []byte) []byte {
+	pub := key.Public().(ed25519.PublicKey)
+	block := &pem.Block{
+		Type:    signaturePEMType,
+		Headers: map[string]string{keyIDHeader: KeyID(pub)},
+		Bytes:   ed25519.Sign(key, digest),
+	}
+	return pem.EncodeToMemory(block)
+}
+
+// SignFile writes the detached signature of fpath in fpath.sig
+func SignFile(key ed25519.PrivateKey, fpath string) error {
+	hash, err := GetHash(fpath)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fpath+SignatureExt, signDigest(key, hash.Sum(nil)), 0o644)
+}
+
+// TrustedKey is a public key of the trust store
+type TrustedKey struct {
+	ID      string
+	Key     ed25519.PublicKey
+	Revoked bool
+}
+
+// TrustStore is the directory of the public keys allowed to sign packages.
+// Revoked keys are kept in the revoked sub directory.
+type TrustStore struct {
+	Dir string
+}
+
+// NewTrustStore returns the trust store kept in dir
+func NewTrustStore(dir string) *TrustStore {
+	return &TrustStore{Dir: dir}
+}
+
+// Add trusts pub and returns its id
+func (t *TrustStore) Add(pub ed25519.PublicKey) (string, error) {
+	id := KeyID(pub)
+	if IsExit(filepath.Join(t.Dir, revokedDir, id+publicKeyExt)) {
+		return "", fmt.Errorf("key %s has been revoked", id)
+	}
+	if err := CreateDirIfNotExist(t.Dir); err != nil {
+		return "", err
+	}
+	return id, WritePublicKey(filepath.Join(t.Dir, id+publicKeyExt), pub)
+}
+
+// Import trusts the public key stored in fpath and returns its id
+func (t *TrustStore) Import(fpath string) (string, error) {
+	pub, err := ReadPublicKey(fpath)
+	if err != nil {
+		return "", err
+	}
+	return t.Add(pub)
+}
+
+// Revoke moves the key id to the revoked keys
+func (t *TrustStore) Revoke(id string) error {
+	fpath := filepath.Join(t.Dir, id+publicKeyExt)
+	if IsNotExist(fpath) {
+		return fmt.Errorf("no trusted key %s", id)
+	}
+	if err := CreateDirIfNotExist(filepath.Join(t.Dir, revokedDir)); err != nil {
+		return err
+	}
+	return os.Rename(fpath, filepath.Join(t.Dir, revokedDir, id+publicKeyExt))
+}
+
+// List returns the trusted and revoked keys
+func (t *TrustStore) List() ([]TrustedKey, error) {
+	var keys []TrustedKey
+	for _, revoked := range []bool{false, true} {
+		dir := t.Dir
+		if revoked {
+			dir = filepath.Join(t.Dir, revokedDir)
+		}
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), publicKeyExt) {
+				continue
+			}
+			pub, err := ReadPublicKey(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, TrustedKey{ID: KeyID(pub), Key: pub, Revoked: revoked})
+		}
+	}
+	return keys, nil
+}
+
+// Verify checks the detached signature of content and returns the id of the signing key
+func (t *TrustStore) Verify(content, signature []byte) (string, error) {
+	sum := sha256.Sum256(content)
+	return t.verifyDigest(sum[:], signature)
+}
+
+// VerifyFile checks fpath against its detached signature fpath.sig
+// and returns the id of the signing key
+func (t *TrustStore) VerifyFile(fpath string) (string, error) {
+	signature, err := os.ReadFile(fpath + SignatureExt)
+	if os.IsNotExist(err) {
+		return "", ErrNotSigned
+	}
+	if err != nil {
+		return "", err
+	}
+	hash, err := GetHash(fpath)
+	if err != nil {
+		return "", err
+	}
+	return t.verifyDigest(hash.Sum(nil), signature)
+}
+
+func (t *TrustStore) verifyDigest(digest, signature []byte) (string, error) {
+	block, _ := pem.Decode(signature)
+	if block == nil || block.Type != signaturePEMType {
+		return "", ErrNotSigned
+	}
+	id := block.Headers[keyIDHeader]
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", fmt.Errorf("invalid key id %q in signature", id)
+	}
+	if IsExit(filepath.Join(t.Dir, revokedDir, id+publicKeyExt)) {
+		return id, ErrRevoked
+	}
+	fpath := filepath.Join(t.Dir, id+publicKeyExt)
+	if IsNotExist(fpath) {
+		return id, ErrUntrusted
+	}
+	pub, err := ReadPublicKey(fpath)
+	if err != nil {
+		return id, err
+	}
+	if !ed25519.Verify(pub, digest, block.Bytes) {
+		return id, fmt.Errorf("bad signature from key %s", id)
+	}
+	return id, nil
+}
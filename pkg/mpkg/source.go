@@ -23,49 +23,310 @@ package mpkg
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 // Source contains uri and sha256 of the tarball
 type Source struct {
-	URI          string `yaml:"uri"`
-	Sha256       string `yaml:"sha256"`
-	Decompressed bool   `yaml:"decompressed"`
+	URI string `yaml:"uri"`
+	// URIs are other places of the tarball, tried in order after URI
+	URIs         []string `yaml:"uris"`
+	Sha256       string   `yaml:"sha256"`
+	Decompressed bool     `yaml:"decompressed"`
 }
 
-// Download Download the tarball
-func (s *Source) Download(filepath string) error {
+// MirrorScheme is the scheme of the URIs on mirrors, mirror://name/path
+const MirrorScheme = "mirror"
 
-	// Get the data
-	resp, err := http.Get(s.URI)
-	if err != nil {
-		return err
+// Mirrors are the base URLs of the mirrors of a mirror:// URI, by name
+type Mirrors map[string][]string
+
+// DefaultMirrors are the mirrors known without config
+var DefaultMirrors = Mirrors{
+	"gnu":         {"https://ftpmirror.gnu.org/gnu", "https://ftp.gnu.org/gnu"},
+	"sourceforge": {"https://downloads.sourceforge.net/project"},
+}
+
+// Expand returns the URLs of uri on its mirrors if it is a mirror:// URI,
+// uri itself otherwise
+func (m Mirrors) Expand(uri string) ([]string, error) {
+	rest, ok := strings.CutPrefix(uri, MirrorScheme+"://")
+	if !ok {
+		return []string{uri}, nil
 	}
-	defer resp.Body.Close()
+	name, fpath, _ := strings.Cut(rest, "/")
+	bases, ok := m[name]
+	if !ok || len(bases) == 0 {
+		return nil, fmt.Errorf("unknown mirror %q of %s", name, uri)
+	}
+	var urls []string
+	for _, base := range bases {
+		urls = append(urls, strings.TrimSuffix(base, "/")+"/"+fpath)
+	}
+	return urls, nil
+}
+
+// AllURIs returns URI and URIs
+func (s *Source) AllURIs() []string {
+	var uris []string
+	if s.URI != "" {
+		uris = append(uris, s.URI)
+	}
+	return append(uris, s.URIs...)
+}
+
+// Candidates returns the URLs the tarball is downloaded from, in order, the
+// mirror:// URIs being expanded with mirrors
+func (s *Source) Candidates(mirrors Mirrors) ([]string, error) {
+	var candidates []string
+	for _, uri := range s.AllURIs() {
+		urls, err := mirrors.Expand(uri)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, urls...)
+	}
+	if len(candidates) == 0 {
+		return nil, errors.New("no uri for the source")
+	}
+	return candidates, nil
+}
+
+var (
+	// DownloadRetries is the number of times a failed download is retried
+	DownloadRetries = 3
+	// DownloadBackoff is the wait before the first retry, doubled at each retry
+	DownloadBackoff = 2 * time.Second
+)
+
+// DownloadTimeout is the longest wait for the response or the data of a
+// download, a stalled download fails and is retried
+const DownloadTimeout = 30 * time.Second
+
+// downloadClient is the client of the downloads, it does not wait forever for a response
+var downloadClient = &http.Client{Transport: newDownloadTransport()}
+
+func newDownloadTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = DownloadTimeout
+	return transport
+}
+
+// errStalled cancels a download that received no data for DownloadTimeout
+var errStalled = errors.New("no data received for " + DownloadTimeout.String())
+
+// PartExt is the extension of a file being downloaded
+const PartExt = ".part"
+
+// The progress of the downloads of progressMinSize bytes or more is logged every progressInterval
+const (
+	progressMinSize  = 10 << 20
+	progressInterval = 2 * time.Second
+)
+
+// StatusError is a download the server answered with an error status
+type StatusError struct {
+	URI        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("could not get %s: %s", e.URI, e.Status)
+}
+
+// Temporary tells if the download may succeed later
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Download downloads the tarball from uri in fpath. The data goes to fpath.part,
+// resumed by the next download if this one is interrupted, which is renamed to
+// fpath once its sha256 matches, if known. Failed requests are retried.
+func (s *Source) Download(ctx context.Context, uri, fpath string) error {
+	part := fpath + PartExt
+	backoff := DownloadBackoff
+	for retry := 0; ; retry++ {
+		sum, err := downloadPart(ctx, uri, part)
+		if err == nil {
+			if s.Sha256 != "" && sum != s.Sha256 {
+				os.Remove(part)
+				return fmt.Errorf("wrong sha256 of %s; want %v, got %v", uri, s.Sha256, sum)
+			}
+			return os.Rename(part, fpath)
+		}
+		var statusErr *StatusError
+		if (errors.As(err, &statusErr) && !statusErr.Temporary()) || retry >= DownloadRetries || ctx.Err() != nil {
+			// Only the data downloaded is kept
+			if info, statErr := os.Stat(part); statErr == nil && info.Size() == 0 {
+				os.Remove(part)
+			}
+			return err
+		}
+		logrus.Warnf("Download of %s failed, retrying in %v: %v", uri, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
 
-	// Create the file
-	out, err := os.Create(filepath)
+// downloadPart downloads uri in part, from the end of part if it exists, and
+// returns the sha256 of part
+func downloadPart(ctx context.Context, uri, part string) (string, error) {
+	out, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o644)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer out.Close()
+	// The data of a previous download is hashed, the download goes on from its end
+	hash := sha256.New()
+	offset, err := io.Copy(hash, out)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return "", err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// Nothing left to download
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent && validContentRange(resp.Header.Get("Content-Range"), offset):
+		logrus.Infof("Resuming the download of %s from %s", uri, FormatSize(offset))
+	case resp.StatusCode >= 200 && resp.StatusCode < 300 && resp.StatusCode != http.StatusPartialContent:
+		// The whole file is sent
+		if offset > 0 {
+			if _, err := out.Seek(0, io.SeekStart); err != nil {
+				return "", err
+			}
+			if err := out.Truncate(0); err != nil {
+				return "", err
+			}
+			hash.Reset()
+			offset = 0
+		}
+	case resp.StatusCode == http.StatusPartialContent:
+		return "", fmt.Errorf("could not resume the download of %s: unexpected range %q", uri, resp.Header.Get("Content-Range"))
+	default:
+		return "", &StatusError{URI: uri, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	writer := io.MultiWriter(out, hash)
+	if resp.ContentLength >= 0 && offset+resp.ContentLength >= progressMinSize {
+		progress := &downloadProgress{name: path.Base(req.URL.Path), done: offset, total: offset + resp.ContentLength, last: time.Now()}
+		writer = io.MultiWriter(writer, progress)
+	}
+	body := newIdleReader(resp.Body, DownloadTimeout, func() { cancel(errStalled) })
+	defer body.Stop()
+	if _, err := io.Copy(writer, body); err != nil {
+		if errors.Is(context.Cause(ctx), errStalled) {
+			return "", fmt.Errorf("download of %s stalled: %w", uri, errStalled)
+		}
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
 
-	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
-	return err
+// idleReader calls stall if no data is read for timeout
+type idleReader struct {
+	io.Reader
+	timeout time.Duration
+	timer   *time.Timer
 }
 
-func (s *Source) DownloadIfNoCache(filepath string) error {
-	if IsExit(filepath) {
-		err := s.Verify(filepath)
+func newIdleReader(reader io.Reader, timeout time.Duration, stall func()) *idleReader {
+	return &idleReader{Reader: reader, timeout: timeout, timer: time.AfterFunc(timeout, stall)}
+}
+
+func (r *idleReader) Read(data []byte) (int, error) {
+	n, err := r.Reader.Read(data)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// Stop stops watching the reader
+func (r *idleReader) Stop() {
+	r.timer.Stop()
+}
+
+// validContentRange checks that the Content-Range value starts at offset
+func validContentRange(value string, offset int64) bool {
+	var start, end int64
+	var size string
+	_, err := fmt.Sscanf(value, "bytes %d-%d/%s", &start, &end, &size)
+	return err == nil && start == offset
+}
+
+// downloadProgress logs the progress of a download
+type downloadProgress struct {
+	name        string
+	done, total int64
+	last        time.Time
+}
+
+func (p *downloadProgress) Write(data []byte) (int, error) {
+	p.done += int64(len(data))
+	if time.Since(p.last) >= progressInterval || p.done == p.total {
+		p.last = time.Now()
+		logrus.Infof("Downloading %s: %s of %s (%d%%)", p.name, FormatSize(p.done), FormatSize(p.total), p.done*100/p.total)
+	}
+	return len(data), nil
+}
+
+// DownloadIfNoCache downloads the tarball in fpath, unless fpath is already
+// the tarball. The candidates are tried in order until one gives the tarball.
+func (s *Source) DownloadIfNoCache(ctx context.Context, fpath string, mirrors Mirrors) error {
+	if IsExit(fpath) {
+		err := s.Verify(fpath)
 		if err == nil {
 			return nil
 		}
 	}
-	return s.Download(filepath)
+	candidates, err := s.Candidates(mirrors)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, uri := range candidates {
+		logrus.Infof("Downloading %s", uri)
+		err := s.Download(ctx, uri, fpath)
+		if err == nil {
+			logrus.Infof("%s served by %s", path.Base(fpath), uri)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		logrus.Warnf("Could not download %s: %v", uri, err)
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("no candidate served the source: %w", errors.Join(errs...))
 }
 
 // Verify verify the sha256 of a file, return error if mismatch
@@ -0,0 +1,379 @@
+/*
+Copyright © 2022 Isteevan Shetoo <isteevan.shetoo@is-info.fr>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package mpkg
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TransactionDirName is the directory of dbDir holding the pending transaction
+const TransactionDirName = ".transaction"
+
+const journalFileName = "journal.xml"
+
+// ErrPendingTransaction is returned when a previous transaction was interrupted
+var ErrPendingTransaction = errors.New("an interrupted transaction is pending")
+
+// JournalEntry is a file operation of a transaction.
+// If Staged is set, the file is moved from Staged to Target.
+// If Backup is set, the previous Target is moved to Backup first.
+// If Dir is set, Target is a directory created with Mode.
+type JournalEntry struct {
+	XMLName xml.Name `xml:"Entry"`
+	Target  string   `xml:"Target"`
+	Staged  string   `xml:"Staged,omitempty"`
+	Backup  string   `xml:"Backup,omitempty"`
+	Dir     bool     `xml:"Dir,omitempty"`
+	Mode    string   `xml:"Mode,omitempty"`
+	UID     int      `xml:"Uid,omitempty"`
+	GID     int      `xml:"Gid,omitempty"`
+}
+
+// Journal is the list of operations of a transaction, written before any
+// change is made so an interrupted transaction can be completed or rolled back
+type Journal struct {
+	XMLName xml.Name `xml:"Journal"`
+	Package string   `xml:"Package"`
+	// Chown applies the recorded owner of the directories
+	Chown   bool           `xml:"Chown,omitempty"`
+	Entries []JournalEntry `xml:"Entry"`
+	// RemoveDirs are removed, if empty, once the transaction is completed
+	RemoveDirs []string `xml:"RemoveDir"`
+}
+
+// Transaction installs a package atomically: the archive is extracted and
+// verified in a staging directory, then files are moved in place with a
+// backup of the files they replace.
+type Transaction struct {
+	Dir     string
+	Journal Journal
+
+	// stagedPrefix is the prefix of the files extracted in the staging directory
+	stagedPrefix string
+}
+
+// NewTransaction starts a new transaction in dir.
+// It fails with ErrPendingTransaction if an interrupted one exists.
+func NewTransaction(dir string) (*Transaction, error) {
+	if IsExit(filepath.Join(dir, journalFileName)) {
+		return nil, ErrPendingTransaction
+	}
+	// Nothing was changed if there is no journal, drop the leftovers
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := CreateDirWithPerm(dir, defaultDirMode); err != nil {
+		return nil, err
+	}
+	return &Transaction{Dir: dir}, nil
+}
+
+// LoadTransaction returns the interrupted transaction of dir, nil if there is none
+func LoadTransaction(dir string) (*Transaction, error) {
+	content, err := os.ReadFile(filepath.Join(dir, journalFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &Transaction{Dir: dir}
+	if err := xml.Unmarshal(content, &t.Journal); err != nil {
+		return nil, fmt.Errorf("could not unmarchal journal: %w", err)
+	}
+	return t, nil
+}
+
+// StagingDir is the directory where the archive is extracted
+func (t *Transaction) StagingDir() string {
+	return filepath.Join(t.Dir, "staging")
+}
+
+func (t *Transaction) backupPath(idx int) string {
+	return filepath.Join(t.Dir, "backup", strconv.Itoa(idx))
+}
+
+// Stage extracts tarball in the staging directory and verifies the hash of every file.
+// The recorded modes, and owners if chown is set, are applied to the staged files.
+// prefix is where files.xml is looked for in packages that do not record their prefix.
+func (t *Transaction) Stage(ctx context.Context, tarball, prefix string, chown bool) (*Set, error) {
+	staging := t.StagingDir()
+	if err := UnarchiveInRoot(ctx, tarball, staging); err != nil {
+		return nil, err
+	}
+	filesXML, err := findFilesXML(staging, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if err := filesXML.VerifyIntegrity(staging); err != nil {
+		return nil, err
+	}
+	if err := filesXML.ApplyAttributes(staging, chown); err != nil {
+		return nil, fmt.Errorf("could not apply file attributes: %w", err)
+	}
+	t.stagedPrefix = filesXML.Prefix
+	t.Journal.Chown = chown
+	return filesXML, nil
+}
+
+// findFilesXML looks for the files.xml of the package extracted in staging,
+// it is stored in the prefix the package was built for
+func findFilesXML(staging, prefix string) (*Set, error) {
+	filesXML, err := UnmarshalFilesXML(filepath.Join(staging, prefix))
+	if err == nil && (filesXML.Prefix == "" || filesXML.Prefix == filepath.Clean(prefix)) {
+		return filesXML, nil
+	}
+	var found *Set
+	err = filepath.WalkDir(staging, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || found != nil || d.IsDir() || d.Name() != "files.xml" {
+			return err
+		}
+		dir := filepath.Dir(path)
+		candidate, err := UnmarshalFilesXML(dir)
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(staging, dir)
+		if err != nil {
+			return err
+		}
+		if candidate.Prefix != "" && candidate.Prefix == filepath.Join("/", rel) {
+			found = candidate
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, errors.New("could not find files.xml in package")
+	}
+	return found, nil
+}
+
+// Relocate installs the staged package in prefix instead of the prefix it was
+// built for. The build prefix is replaced in relocatable files, see IsRelocatable.
+// It returns the files that still contain the build prefix.
+func (t *Transaction) Relocate(filesXML *Set, prefix string) ([]string, error) {
+	if filesXML.Prefix == "" {
+		return nil, errors.New("the package does not record its build prefix, it can not be relocated")
+	}
+	prefix = filepath.Clean(prefix)
+	if prefix == filesXML.Prefix {
+		return nil, nil
+	}
+	var hardcoded []string
+	for idx, file := range filesXML.Files {
+		staged := filepath.Join(t.StagingDir(), filesXML.InstallPath(file))
+		rewritten, found, err := RelocateFile(staged, filesXML.Prefix, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("could not relocate %s: %w", file.Path, err)
+		}
+		if !rewritten {
+			if found {
+				hardcoded = append(hardcoded, file.Path)
+			}
+			continue
+		}
+		hash, err := GetHashString(staged)
+		if err != nil {
+			return nil, err
+		}
+		filesXML.Files[idx].Hash = hash
+		if info, err := os.Stat(staged); err == nil {
+			filesXML.Files[idx].Size = info.Size()
+		}
+	}
+	filesXML.Prefix = prefix
+	return hardcoded, nil
+}
+
+// Plan prepares the installation of the staged package and writes the journal.
+// Files of the previously installed version of the package are replaced, other
+// existing files are conflicts unless force is set. The record of the package
+// is put in db, and the updated database file is installed with the files;
+// db must be open with OpenDB until the transaction is committed.
+func (t *Transaction) Plan(filesXML *Set, record InstalledPackage, root string, db *DB, force bool) error {
+	staging := t.StagingDir()
+	stagedFiles := &Set{Prefix: t.stagedPrefix}
+	owners := db.Files()
+	var replaced *Set
+	replacedName := ""
+	if old := db.Get(record.Name); old != nil {
+		replaced = old.Files
+		replacedName = old.GetFullName()
+	}
+
+	var conflicts []string
+	addEntry := func(target, staged string) {
+		entry := JournalEntry{Target: target, Staged: staged}
+		if IsLinkOrExist(target) {
+			entry.Backup = t.backupPath(len(t.Journal.Entries))
+		}
+		t.Journal.Entries = append(t.Journal.Entries, entry)
+	}
+
+	newDirs := map[string]bool{}
+	for _, dir := range filesXML.Dirs {
+		target := filepath.Join(root, filesXML.DirPath(dir))
+		newDirs[filesXML.DirPath(dir)] = true
+		if !IsLinkOrExist(target) {
+			t.Journal.Entries = append(t.Journal.Entries, JournalEntry{
+				Target: target,
+				Dir:    true,
+				Mode:   dir.Mode,
+				UID:    dir.UID,
+				GID:    dir.GID,
+			})
+		}
+	}
+
+	newFiles := map[string]bool{}
+	for _, file := range filesXML.Files {
+		installPath := filesXML.InstallPath(file)
+		newFiles[installPath] = true
+		target := filepath.Join(root, installPath)
+		if IsLinkOrExist(target) && !force {
+			owner := owners[installPath]
+			if owner == "" {
+				conflicts = append(conflicts, fmt.Sprintf("%s exists and is not owned by any package", target))
+			} else if owner != replacedName {
+				conflicts = append(conflicts, fmt.Sprintf("%s is owned by %s", target, owner))
+			}
+		}
+		addEntry(target, filepath.Join(staging, stagedFiles.InstallPath(file)))
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("conflicting files:\n  %s", strings.Join(conflicts, "\n  "))
+	}
+
+	// Remove what is left of the replaced version
+	if replaced != nil {
+		for _, file := range replaced.Files {
+			installPath := replaced.InstallPath(file)
+			if !newFiles[installPath] {
+				addEntry(filepath.Join(root, installPath), "")
+			}
+		}
+		// The replaced version is one of the owners of its directories
+		dirOwners := db.Dirs()
+		for _, dir := range replaced.Dirs {
+			dirPath := replaced.DirPath(dir)
+			if !newDirs[dirPath] && dirOwners[dirPath] <= 1 {
+				t.Journal.RemoveDirs = append(t.Journal.RemoveDirs, filepath.Join(root, dirPath))
+			}
+		}
+	}
+	// deepest directories first
+	sort.SliceStable(t.Journal.RemoveDirs, func(i, j int) bool {
+		return len(t.Journal.RemoveDirs[i]) > len(t.Journal.RemoveDirs[j])
+	})
+
+	// The record of the database holds the prefix the package is installed in
+	record.Files = filesXML
+	record.Files.Info = nil
+	db.Put(record)
+	content, err := db.Marshal()
+	if err != nil {
+		return fmt.Errorf("could not marchal the database: %w", err)
+	}
+	stagedDB := filepath.Join(t.Dir, filepath.Base(db.Path()))
+	if err := os.WriteFile(stagedDB, content, dbFileMode); err != nil {
+		return err
+	}
+	addEntry(db.Path(), stagedDB)
+
+	t.Journal.Package = record.GetFullName()
+	return t.writeJournal()
+}
+
+func (t *Transaction) writeJournal() error {
+	output, err := xml.MarshalIndent(t.Journal, "", "    ")
+	if err != nil {
+		return fmt.Errorf("could not marchal journal: %v", err)
+	}
+	return WriteFileAtomic(filepath.Join(t.Dir, journalFileName), output, defaultFileMode)
+}
+
+// Commit applies the journal. It can be called again to complete an interrupted transaction.
+func (t *Transaction) Commit() error {
+	for _, entry := range t.Journal.Entries {
+		if entry.Dir {
+			if err := CreateDirWithPerm(entry.Target, 0o700); err != nil {
+				return fmt.Errorf("could not create %s: %w", entry.Target, err)
+			}
+			if err := applyAttributes(entry.Target, entry.Mode, entry.UID, entry.GID, t.Journal.Chown); err != nil {
+				return fmt.Errorf("could not set attributes of %s: %w", entry.Target, err)
+			}
+			continue
+		}
+		if entry.Backup != "" && IsNotExist(entry.Backup) && IsLinkOrExist(entry.Target) {
+			if err := MoveFile(entry.Target, entry.Backup); err != nil {
+				return fmt.Errorf("could not backup %s: %w", entry.Target, err)
+			}
+		}
+		if entry.Staged != "" && IsLinkOrExist(entry.Staged) {
+			if err := MoveFile(entry.Staged, entry.Target); err != nil {
+				return fmt.Errorf("could not install %s: %w", entry.Target, err)
+			}
+		}
+	}
+	for _, dir := range t.Journal.RemoveDirs {
+		_ = os.Remove(dir)
+	}
+	return os.RemoveAll(t.Dir)
+}
+
+// Rollback restores the files replaced by the transaction and removes the installed ones
+func (t *Transaction) Rollback() error {
+	for idx := len(t.Journal.Entries) - 1; idx >= 0; idx-- {
+		entry := t.Journal.Entries[idx]
+		if entry.Dir {
+			// only removed if empty
+			_ = os.Remove(entry.Target)
+			continue
+		}
+		if entry.Backup == "" {
+			if entry.Staged != "" {
+				if err := os.Remove(entry.Target); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			continue
+		}
+		if IsLinkOrExist(entry.Backup) {
+			if err := MoveFile(entry.Backup, entry.Target); err != nil {
+				return fmt.Errorf("could not restore %s: %w", entry.Target, err)
+			}
+		}
+	}
+	return os.RemoveAll(t.Dir)
+}
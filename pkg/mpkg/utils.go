@@ -25,12 +25,14 @@ import (
 	"bufio"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 var Macros = map[string]string{
@@ -53,6 +55,7 @@ func GetHash(filepath string) (hash.Hash, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
 	hash := sha256.New()
 	if _, err := io.Copy(hash, f); err != nil {
@@ -64,18 +67,40 @@ func GetHash(filepath string) (hash.Hash, error) {
 func GetHashString(filepath string) (string, error) {
 	hash, err := GetHash(filepath)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func GetFileType(path string) string {
-	for prefix, typ := range FileTypes {
-		if strings.HasPrefix(path, prefix) {
-			return typ
+// GetFileType returns the type of the file at path, a path relative to the
+// prefix or an absolute path. The longest matching key of FileTypes and rules
+// is used, rules taking precedence over FileTypes for the same key.
+func GetFileType(path string, rules ...FileTypeRule) string {
+	key := path
+	if !filepath.IsAbs(path) {
+		key = filepath.Join(PrefixKey, path)
+	}
+	typ := DefaultFileType
+	longest := -1
+	match := func(prefix, ftype string) {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if key != prefix && !strings.HasPrefix(key, prefix+"/") {
+			return
+		}
+		if len(prefix) >= longest {
+			typ = ftype
+			longest = len(prefix)
 		}
 	}
-	return "data"
+	// two different keys of FileTypes matching path have different lengths,
+	// so the iteration order does not matter
+	for prefix, ftype := range FileTypes {
+		match(prefix, ftype)
+	}
+	for _, rule := range rules {
+		match(rule.Path, rule.Type)
+	}
+	return typ
 }
 
 func IsExit(path string) bool {
@@ -87,6 +112,92 @@ func IsNotExist(path string) bool {
 	return os.IsNotExist(err)
 }
 
+// IsLinkOrExist returns true if path exists, without following symlinks
+func IsLinkOrExist(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// WriteFileAtomic writes data in a temporary file next to fpath then renames it
+func WriteFileAtomic(fpath string, data []byte, perm os.FileMode) error {
+	tmp := fpath + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fpath)
+}
+
+// MoveFile renames src to dst, creating the parent directory of dst.
+// If they are not on the same file system, src is copied next to dst
+// and renamed, so dst is always replaced atomically.
+func MoveFile(src, dst string) error {
+	if err := CreateDirIfNotExist(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	tmp := dst + ".mypkg-tmp"
+	if err := CopyFile(src, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// CopyFile copies src in dst with the same mode, mtime and, when allowed, owner.
+// Symlinks are copied as symlinks
+func CopyFile(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(dst)
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+		copyOwner(info, dst)
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	copyOwner(info, dst)
+	// chown may have cleared setuid and setgid bits
+	if err := os.Chmod(dst, info.Mode()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// copyOwner gives dst the owner of info, errors are ignored as only root can do it
+func copyOwner(info os.FileInfo, dst string) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		_ = os.Lchown(dst, int(stat.Uid), int(stat.Gid))
+	}
+}
+
 func CreateDirIfNotExist(dir string) error {
 	if IsNotExist(dir) {
 		// create the path
@@ -138,16 +249,19 @@ func GetStepsFromMacros(steps []string) ([]string, error) {
 				return nil, fmt.Errorf("could not get command if macro %v", step)
 			}
 		}
-		formatedSteps = append(formatedSteps, step+";")
+		formatedSteps = append(formatedSteps, step)
 	}
 	return formatedSteps, nil
 }
 
 func DeleteEmptyFolder(folder string) error {
 	info, err := os.Stat(folder)
-	if !info.IsDir() {
+	if err != nil {
 		return err
 	}
+	if !info.IsDir() {
+		return nil
+	}
 	files, err := os.ReadDir(folder)
 	if err != nil {
 		return err
@@ -171,3 +285,30 @@ func DeleteEmptyFolder(folder string) error {
 	}
 	return nil
 }
+
+// SameFile checks if a and b are the same file
+func SameFile(a, b string) (bool, error) {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(infoA, infoB), nil
+}
+
+// FormatSize returns size in a human readable form, like 1.5 MiB
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}